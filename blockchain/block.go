@@ -1,68 +1,57 @@
 package blockchain
 
 import (
-    "bytes"
-    "encoding/gob"
-    "log"
+    "context"
     "time"
 )
 
+const BlockVersion = 1
+
 type Block struct {
-    Timestamp int64
-    Hash []byte
+    BlockHeader
     Transactions []*Transaction
-    PrevHash []byte
-    Nonce int
-    Height int
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-     block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
-     pow := NewProof(block)
-     nonce, hash := pow.Run()
-
-     block.Hash = hash[:]
-     block.Nonce = nonce
-     
-     return block
+func NewBlock(txs []*Transaction, prevHash []byte, height, difficulty, sincerity int) *Block {
+    header := BlockHeader{BlockVersion, time.Now().Unix(), []byte{}, prevHash, nil, 0, height, difficulty, sincerity}
+    block := &Block{header, txs}
+    block.MerkleRoot = block.HashTransactions()
+    return block
 }
 
-func Genesis(coinbase *Transaction) *Block {
-    return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+func (b *Block) Mine(ctx context.Context, workers int) (MiningStats, error) {
+    return NewProof(&b.BlockHeader).Run(ctx, workers)
 }
 
-func (b *Block) HashTransactions() []byte {
+func (b *Block) MerkleTree() *MerkleTree {
     var txHashes [][]byte
 
     for _, tx := range b.Transactions {
         txHashes = append(txHashes, tx.Serialize())
     }
-    tree := NewMerkleTree(txHashes)
-
-    return tree.RootNode.Data
+    return NewMerkleTree(txHashes)
 }
 
-func (b *Block) Serialize() []byte {
-    var res bytes.Buffer
-    encoder := gob.NewEncoder(&res)
-
-    err := encoder.Encode(b)
-    Handle(err)
-
-    return res.Bytes()
+func (b *Block) HashTransactions() []byte {
+    return b.MerkleTree().RootNode.Data
 }
 
-func Deserialize(data []byte) *Block {
-    var block Block
-
-    decoder := gob.NewDecoder(bytes.NewReader(data))
-    err := decoder.Decode(&block)
-    Handle(err)
-    return &block
+func (b *Block) Serialize() []byte {
+    w := newWriter()
+    b.BlockHeader.encode(w)
+    encodeTransactions(w, b.Transactions)
+    return w.Bytes()
 }
 
-func Handle(err error) {
+func Deserialize(data []byte) (*Block, error) {
+    r, err := newReader(data, "block")
     if err != nil {
-        log.Panic(err)
+        return nil, err
+    }
+    header := decodeHeader(r)
+    txs := decodeTransactions(r)
+    if err := finish(r, "block"); err != nil {
+        return nil, err
     }
+    return &Block{header, txs}, nil
 }
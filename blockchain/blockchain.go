@@ -1,104 +1,202 @@
 package blockchain
 
 import (
-	"github.com/dgraph-io/badger"
+	"github.com/viscory/reciprocus/storage"
 	
     "crypto/ecdsa"
 	"encoding/hex"
     "path/filepath"
 	
     "bytes"
+	"context"
 	"errors"
 	"fmt"
-	"log"
-	"os"
 	"runtime"
-    "strings"
 )
 
-const (
-	dbPath = "./tmp/blocks_%s"
-    genesisData = "First transaction"
+const dbPath = "blocks_%s"
+
+var (
+	ErrNoBlockChain     = errors.New("no existing blockchain found, create one")
+	ErrBlockChainExists = errors.New("blockchain already exists")
 )
 
 type BlockChain struct {
-	LastHash []byte
-	Database *badger.DB
+	LastHash         []byte
+	Database         storage.Store
+	Params           ChainParams
+	TxIndex          bool
+	Light            bool
+	OnOrphanedTx     func(tx *Transaction)
+	OnConnectedBlock func(block *Block)
+}
+
+func chainPath(dataDir, nodeId string, params ChainParams) string {
+	return filepath.Join(params.DataDir(dataDir), fmt.Sprintf(dbPath, nodeId))
 }
 
-func DBexists(path string) bool {
-	if _, err := os.Stat(path + "/MANIFEST"); os.IsNotExist(err) {
-		return false
+func ContinueBlockChain(dataDir, nodeId, network string) (*BlockChain, error) {
+	params, err := LookupNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	path := chainPath(dataDir, nodeId, params)
+	if !storage.BadgerExists(path) {
+		return nil, ErrNoBlockChain
+	}
+
+	db, err := storage.OpenBadger(path)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := LoadBlockChain(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if chain.Params.Name != network {
+		db.Close()
+		return nil, fmt.Errorf("%w: %s holds a %s chain", ErrWrongNetwork, path, chain.Params.Name)
+	}
+	return chain, nil
+}
+
+func InitBlockChain(dataDir, nodeId, network string, txIndex bool) (*BlockChain, error) {
+	params, err := LookupNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	path := chainPath(dataDir, nodeId, params)
+	if storage.BadgerExists(path) {
+		return nil, ErrBlockChainExists
+	}
+
+	db, err := storage.OpenBadger(path)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := NewBlockChain(db, network, txIndex)
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
-	return true
+	return chain, nil
 }
 
-func ContinueBlockChain(nodeId string) *BlockChain {
+func LoadBlockChain(db storage.Store) (*BlockChain, error) {
 	var lastHash []byte
-    path := fmt.Sprintf(dbPath, nodeId)
-	if DBexists(path) == false {
-		fmt.Println("No existing blockchain found, create one!")
-		runtime.Goexit()
+	err := db.View(func(txn storage.Txn) error {
+		var err error
+		lastHash, err = txn.Get([]byte("lh"))
+		return err
+	})
+	if err == storage.ErrNotFound {
+		return nil, ErrNoBlockChain
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: reading last hash: %s", ErrCorruptData, err)
 	}
 
-	opts := badger.DefaultOptions
-	opts.Dir = path
-	opts.ValueDir = path
+	if err := checkFormat(db); err != nil {
+		return nil, err
+	}
+	network, err := loadNetwork(db)
+	if err != nil {
+		return nil, err
+	}
+	params, err := LookupNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGenesis(db, params); err != nil {
+		return nil, err
+	}
+	txIndex, err := loadTxIndex(db)
+	if err != nil {
+		return nil, err
+	}
 
-    db, err := openDB(path, opts)
-	Handle(err) 
+	chain := BlockChain{LastHash: lastHash, Database: db, Params: params, TxIndex: txIndex}
+	return &chain, nil
+}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		lastHash, err = item.Value()
-		return err
+func checkGenesis(db storage.Store, params ChainParams) error {
+	return db.View(func(txn storage.Txn) error {
+		hash, err := txn.Get(heightKey(0))
+		if err == storage.ErrNotFound {
+			return fmt.Errorf("%w: no genesis block", ErrCorruptData)
+		} else if err != nil {
+			return err
+		}
+		if hex.EncodeToString(hash) != params.Genesis.Hash {
+			return fmt.Errorf("%w: database holds %x, %s expects %s", ErrWrongGenesis, hash, params.Name, params.Genesis.Hash)
+		}
+		return nil
 	})
-	Handle(err)
-	chain := BlockChain{lastHash, db}
-	return &chain
 }
 
-func InitBlockChain(address, nodeId string) *BlockChain {
+func NewBlockChain(db storage.Store, network string, txIndex bool) (*BlockChain, error) {
 	var lastHash []byte
-    path := fmt.Sprintf(dbPath, nodeId)
-	if DBexists(path) {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+	params, err := LookupNetwork(network)
+	if err != nil {
+		return nil, err
 	}
 
-	opts := badger.DefaultOptions
-	opts.Dir = path
-	opts.ValueDir = path
+	genesis, err := params.GenesisBlock()
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := openDB(path, opts)
-	Handle(err)
+	err = db.Update(func(txn storage.Txn) error {
+		if _, err := txn.Get([]byte("lh")); err == nil {
+			return ErrBlockChainExists
+		} else if err != storage.ErrNotFound {
+			return err
+		}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData, 0)
-		genesis := Genesis(cbtx)
 		fmt.Println("Genesis created")
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), genesis.Hash)
+		if err := putBlock(txn, genesis, NewProof(&genesis.BlockHeader).Work().Bytes()); err != nil {
+			return err
+		}
+		if err := txn.Put(heightKey(0), genesis.Hash); err != nil {
+			return err
+		}
+		UTXOSet := UTXOSet{}
+		if err := UTXOSet.update(txn, genesis); err != nil {
+			return err
+		}
+		if txIndex {
+			if err := txn.Put(txIndexKey, []byte{1}); err != nil {
+				return err
+			}
+			if err := indexTransactions(txn, genesis); err != nil {
+				return err
+			}
+		}
+		if err := txn.Put([]byte("net"), []byte(network)); err != nil {
+			return err
+		}
+		if err := txn.Put(formatKey, []byte{EncodingVersion}); err != nil {
+			return err
+		}
 		lastHash = genesis.Hash
-		return err
+		return txn.Put([]byte("lh"), genesis.Hash)
 	})
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
-	blockchain := BlockChain{lastHash, db}
-	return &blockchain
+	blockchain := BlockChain{LastHash: lastHash, Database: db, Params: params, TxIndex: txIndex}
+	return &blockchain, nil
 }
 
 func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
     var block Block
-    err := chain.Database.View(func(txn *badger.Txn) error {
-        if item, err := txn.Get(blockHash); err != nil {
-            return errors.New("Block is not found")
-        } else {
-            blockData, _ := item.Value()
-            block = *Deserialize(blockData)
+    err := chain.Database.View(func(txn storage.Txn) error {
+        b, err := getBlock(txn, blockHash)
+        if err != nil {
+            return err
         }
+        block = *b
         return nil
     })
     if err != nil {
@@ -107,106 +205,126 @@ func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
     return block, nil
 }
 
-func (chain *BlockChain) GetBlockHashes() [][]byte {
+func (chain *BlockChain) GetBlockHashes() ([][]byte, error) {
     var blocks [][]byte
 
     iter := chain.Iterator()
     for {
-        block := iter.Next()
-        blocks = append(blocks, block.Hash)
-        if len(block.PrevHash) == 0 {
+        header, err := iter.NextHeader()
+        if err != nil {
+            return nil, err
+        }
+        blocks = append(blocks, header.Hash)
+        if len(header.PrevHash) == 0 {
             break
         }
     }
-    return blocks
+    return blocks, nil
 }
 
-func (chain *BlockChain) GetBestHeight() int {
-    var lastBlock Block
-    err := chain.Database.View(func(txn *badger.Txn) error {
-        item, err := txn.Get([]byte("lh"))
-        Handle(err)
-        lastHash, _ := item.Value()
-        item, err = txn.Get(lastHash)
-        Handle(err)
-        lastBlockData, _ := item.Value()
-        lastBlock = *Deserialize(lastBlockData)
-        return nil
-    })
-    Handle(err)
-
-    return lastBlock.Height
+func (chain *BlockChain) GetBestHeight() (int, error) {
+    header, err := chain.GetHeader(chain.LastHash)
+    if err != nil {
+        return 0, err
+    }
+    return header.Height, nil
 }
 
-func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-    var lastHeight int
+func (chain *BlockChain) PrepareBlock(transactions []*Transaction, sincerity int) (*Block, error) {
+	candidate := &Block{BlockHeader{Sincerity: sincerity}, transactions}
+	err := chain.Database.View(func(txn storage.Txn) error {
+		return chain.checkBlockTransactions(txn, candidate)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	for _, tx := range transactions {
-		if chain.VerifyTransaction(tx) != true {
-			log.Panic("Invalid Transaction")
-		}
+	lastHeader, err := chain.GetHeader(chain.LastHash)
+	if err != nil {
+		return nil, err
 	}
+	difficulty, err := chain.NextDifficulty(&lastHeader)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlock(transactions, lastHeader.Hash, lastHeader.Height+1, difficulty, sincerity), nil
+}
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		lastHash, err = item.Value()
-        item, err = txn.Get(lastHash)
-        Handle(err)
-        lastBlockData, _ := item.Value()
-        lastBlock := Deserialize(lastBlockData)
-        lastHeight = lastBlock.Height
-		return err
-	})
-	Handle(err)
+func (chain *BlockChain) MineBlock(ctx context.Context, transactions []*Transaction, sincerity int) (*Block, MiningStats, error) {
+	newBlock, err := chain.PrepareBlock(transactions, sincerity)
+	if err != nil {
+		return nil, MiningStats{}, err
+	}
+	stats, err := newBlock.Mine(ctx, runtime.NumCPU())
+	if err != nil {
+		return nil, stats, err
+	}
+	if err := chain.AddBlock(newBlock); err != nil {
+		return nil, stats, err
+	}
+	return newBlock, stats, nil
+}
 
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+func (chain *BlockChain) AddBlock(block *Block) error {
+    if chain.HasBlock(block.Hash) {
+        return nil
+    }
+    if err := CheckBlock(block); err != nil {
+        return err
+    }
+    if err := chain.checkBlockContext(block); err != nil {
+        return err
+    }
 
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
-		chain.LastHash = newBlock.Hash
-		return err
-	})
-	Handle(err)
-	return newBlock
-}
+    parentWork, err := chain.GetChainWork(block.PrevHash)
+    if err != nil {
+        return err
+    }
+    work := parentWork.Add(parentWork, NewProof(&block.BlockHeader).Work())
+    tipWork, err := chain.GetChainWork(chain.LastHash)
+    if err != nil {
+        return err
+    }
 
-func (chain *BlockChain) AddBlock(block *Block) {
-    err := chain.Database.Update(func(txn *badger.Txn) error {
-        if _, err := txn.Get(block.Hash); err == nil {
-            return nil
+    if bytes.Equal(block.PrevHash, chain.LastHash) {
+        err := chain.Database.Update(func(txn storage.Txn) error {
+            if err := chain.checkBlockTransactions(txn, block); err != nil {
+                return err
+            }
+            if err := putBlock(txn, block, work.Bytes()); err != nil {
+                return err
+            }
+            return chain.connectBlock(txn, block)
+        })
+        if err != nil {
+            return err
         }
-        blockData := block.Serialize()
-        err := txn.Set(block.Hash, blockData)
-        Handle(err)
-
-        item, err := txn.Get([]byte("lh"))
-        Handle(err)
-        lastHash, _ := item.Value()
-        item, err = txn.Get(lastHash)
-        Handle(err)
-        lastBlockData, _ := item.Value()
-        lastBlock := Deserialize(lastBlockData)
-        if block.Height > lastBlock.Height {
-            err = txn.Set([]byte("lh"), block.Hash)
-            Handle(err)
-            chain.LastHash = block.Hash
+        chain.LastHash = block.Hash
+        if chain.OnConnectedBlock != nil {
+            chain.OnConnectedBlock(block)
         }
-        return nil 
-    })
-    Handle(err)
+        return nil
+    }
+
+    if err := chain.storeBlock(block, work); err != nil {
+        return err
+    }
+    if work.Cmp(tipWork) > 0 {
+        return chain.reorganize(block)
+    }
+    return nil
 }
 
-func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
+func (chain *BlockChain) FindUTXO() (map[string]TxOutputs, error) {
 	UTXO := make(map[string]TxOutputs)
 	spentTXOs := make(map[string][]int)
 
 	iter := chain.Iterator()
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
 		
@@ -221,6 +339,7 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 				}
 				outs := UTXO[txID]
 				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
 				UTXO[txID] = outs
 			}
 			if tx.IsCoinBase() == false {
@@ -235,74 +354,38 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 			break
 		}
 	}
-	return UTXO
+	return UTXO, nil
 }
 
 func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
-	iter := bc.Iterator()
-	for {
-		block := iter.Next()
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-		}
-
-		if len(block.PrevHash) == 0 {
-			break
-		}
-	}
-
-	return Transaction{}, errors.New("Transaction does not exist")
+	tx, _, err := bc.LocateTransaction(ID)
+	return tx, err
 }
 
-func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		prevTX, err := bc.FindTransaction(in.ID)
-		Handle(err)
+		if err != nil {
+			return err
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
-	tx.Sign(privKey, prevTXs)
+	return tx.Sign(privKey, prevTXs)
 }
 
 func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
+	_, err := bc.ValidateTransaction(tx)
+	return err == nil
+}
+
+func (bc *BlockChain) ValidateTransaction(tx *Transaction) (int, error) {
 	if tx.IsCoinBase() {
-		return true
+		return 0, nil
 	}
-    prevTXs := make(map[string]Transaction)
-	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
-		Handle(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	if err := bc.Params.CheckTransaction(tx); err != nil {
+		return 0, err
 	}
-
-	return tx.Verify(prevTXs)
-}
-
-func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
-    lockPath := filepath.Join(dir, "LOCK")
-    if err := os.Remove(lockPath); err != nil {
-        return nil, fmt.Errorf(`removing "LOCK": %s`, err)
-    }
-    retryOpts := originalOpts
-    retryOpts.Truncate = true
-    db, err := badger.Open(retryOpts)
-    return db, err
-}
-
-func openDB(dir string, opts badger.Options) (*badger.DB, error) {
-    if db, err := badger.Open(opts); err != nil {
-        if strings.Contains(err.Error(), "LOCK") {
-            if db, err := retry(dir, opts); err == nil {
-            log.Println("database unlocked, value log truncated")
-            return db, nil
-            }
-        log.Println("could not unlock databse:", err)
-        }
-    return nil, err
-    } else {
-    return db, nil
-    }
+	return bc.Params.CheckTransactionInputs(tx, bc.LookupUnspent)
 }
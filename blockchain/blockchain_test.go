@@ -0,0 +1,300 @@
+package blockchain
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "testing"
+
+    "github.com/viscory/reciprocus/storage"
+    "github.com/viscory/reciprocus/wallet"
+)
+
+func newTestChain(t *testing.T) *BlockChain {
+    chain, err := NewBlockChain(storage.NewMemory(), "regtest", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return chain
+}
+
+func TestNewBlockChainConnectsGenesis(t *testing.T) {
+    chain := newTestChain(t)
+
+    UTXOSet := UTXOSet{Blockchain: chain}
+    count, err := UTXOSet.CountTransactions()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if count != 1 {
+        t.Errorf("UTXO set holds %d transactions, want the genesis coinbase", count)
+    }
+
+    loaded, err := LoadBlockChain(chain.Database)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(loaded.LastHash, chain.LastHash) || loaded.Params.Name != "regtest" {
+        t.Errorf("loaded tip %x on %s, want %x on regtest", loaded.LastHash, loaded.Params.Name, chain.LastHash)
+    }
+}
+
+func TestMineAndSpendInMemory(t *testing.T) {
+    chain := newTestChain(t)
+    from, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    to, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    version := chain.Params.AddressVersion
+    fromAddr, toAddr := string(from.VersionedAddress(version)), string(to.VersionedAddress(version))
+
+    coinbase, err := CoinbaseTx(fromAddr, "", chain.Params.BlockReward(0))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := chain.MineBlock(context.Background(), []*Transaction{coinbase}, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    UTXOSet := UTXOSet{Blockchain: chain}
+    tx, err := NewTransaction(from, toAddr, 100, 1, &UTXOSet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    coinbase, err = CoinbaseTx(fromAddr, "", chain.Params.BlockReward(0)+1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    block, _, err := chain.MineBlock(context.Background(), []*Transaction{coinbase, tx}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if block.Height != 2 {
+        t.Errorf("mined height %d, want 2", block.Height)
+    }
+
+    outs, err := UTXOSet.FindUTXO(wallet.PublicKeyHash(to.PublicKey))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(outs) != 1 || outs[0].Value != 100 {
+        t.Errorf("recipient outputs = %v, want one of 100", outs)
+    }
+}
+
+func TestSpendTwoOutputsOfOneTransaction(t *testing.T) {
+    chain := newTestChain(t)
+    from, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    to, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    version := chain.Params.AddressVersion
+    fromAddr, toAddr := string(from.VersionedAddress(version)), string(to.VersionedAddress(version))
+    reward := chain.Params.BlockReward(0)
+
+    coinbase, err := CoinbaseTx(fromAddr, "", reward)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := chain.MineBlock(context.Background(), []*Transaction{coinbase}, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    UTXOSet := UTXOSet{Blockchain: chain}
+    split, err := NewTransaction(from, fromAddr, 100, 1, &UTXOSet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(split.Outputs) != 2 {
+        t.Fatalf("self-send has %d outputs, want a payment and change", len(split.Outputs))
+    }
+    coinbase, err = CoinbaseTx(toAddr, "", reward+1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := chain.MineBlock(context.Background(), []*Transaction{coinbase, split}, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    tx, err := NewTransaction(from, toAddr, reward-2, 1, &UTXOSet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(tx.Inputs) != 2 {
+        t.Fatalf("spend has %d inputs, want both outputs of the self-send", len(tx.Inputs))
+    }
+    if _, err := chain.ValidateTransaction(tx); err != nil {
+        t.Fatal(err)
+    }
+    coinbase, err = CoinbaseTx(toAddr, "", reward+1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := chain.MineBlock(context.Background(), []*Transaction{coinbase, tx}, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    outs, err := UTXOSet.FindUTXO(wallet.PublicKeyHash(from.PublicKey))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(outs) != 0 {
+        t.Errorf("sender still holds %d outputs", len(outs))
+    }
+}
+
+func mineOn(t *testing.T, chain *BlockChain, parent *Block, to string, value int) *Block {
+    coinbase, err := CoinbaseTx(to, "", value)
+    if err != nil {
+        t.Fatal(err)
+    }
+    difficulty, err := chain.NextDifficulty(&parent.BlockHeader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    block := NewBlock([]*Transaction{coinbase}, parent.Hash, parent.Height+1, difficulty, 0)
+    if _, err := block.Mine(context.Background(), 1); err != nil {
+        t.Fatal(err)
+    }
+    return block
+}
+
+func TestFailedReorgInvalidatesBranch(t *testing.T) {
+    chain := newTestChain(t)
+    w, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := string(w.VersionedAddress(chain.Params.AddressVersion))
+    reward := chain.Params.BlockReward(0)
+
+    genesis, err := chain.GetBlock(chain.LastHash)
+    if err != nil {
+        t.Fatal(err)
+    }
+    parent := &genesis
+    for i := 0; i < 2; i++ {
+        parent = mineOn(t, chain, parent, addr, reward)
+        if err := chain.AddBlock(parent); err != nil {
+            t.Fatal(err)
+        }
+    }
+    tip := chain.LastHash
+
+    fork := mineOn(t, chain, &genesis, addr, reward)
+    bad := mineOn(t, chain, fork, addr, reward+1)
+    child := mineOn(t, chain, bad, addr, reward)
+    for _, block := range []*Block{fork, bad} {
+        if err := chain.AddBlock(block); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := chain.AddBlock(child); !errors.Is(err, ErrBadCoinbase) {
+        t.Fatalf("reorganization onto an overpaying coinbase returned %v", err)
+    }
+    if !bytes.Equal(chain.LastHash, tip) {
+        t.Errorf("tip moved to %x after a failed reorganization", chain.LastHash)
+    }
+    if !chain.HasBlock(fork.Hash) || chain.HasBlock(bad.Hash) || chain.HasBlock(child.Hash) {
+        t.Error("the invalid block and its descendants should be removed and the valid fork block kept")
+    }
+    grandchild := mineOn(t, chain, child, addr, reward)
+    if err := chain.AddBlock(grandchild); !errors.Is(err, ErrInvalidBranch) {
+        t.Errorf("block on an invalid branch returned %v", err)
+    }
+
+    UTXOSet := UTXOSet{Blockchain: chain}
+    count, err := UTXOSet.CountTransactions()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if count != 3 {
+        t.Errorf("UTXO set holds %d transactions after the failed reorganization, want 3", count)
+    }
+
+    parent = fork
+    for i := 0; i < 2; i++ {
+        parent = mineOn(t, chain, parent, addr, reward)
+        if err := chain.AddBlock(parent); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if !bytes.Equal(chain.LastHash, parent.Hash) {
+        t.Fatalf("tip is %x, want the heavier fork %x", chain.LastHash, parent.Hash)
+    }
+    count, err = UTXOSet.CountTransactions()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if count != 4 {
+        t.Errorf("UTXO set holds %d transactions after the reorganization, want 4", count)
+    }
+}
+
+func TestLightChainFollowsReorg(t *testing.T) {
+    chain := newTestChain(t)
+    light, err := NewLightChain(storage.NewMemory(), "regtest")
+    if err != nil {
+        t.Fatal(err)
+    }
+    w, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := string(w.VersionedAddress(chain.Params.AddressVersion))
+    reward := chain.Params.BlockReward(0)
+
+    sync := func() []*BlockHeader {
+        locator, err := light.BlockLocator()
+        if err != nil {
+            t.Fatal(err)
+        }
+        headers, err := chain.GetHeaders(locator)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := light.AddHeaders(headers); err != nil {
+            t.Fatal(err)
+        }
+        return headers
+    }
+
+    genesis, err := chain.GetBlock(chain.LastHash)
+    if err != nil {
+        t.Fatal(err)
+    }
+    parent := &genesis
+    for i := 0; i < 2; i++ {
+        parent = mineOn(t, chain, parent, addr, reward)
+        if err := chain.AddBlock(parent); err != nil {
+            t.Fatal(err)
+        }
+    }
+    sync()
+
+    parent = &genesis
+    for i := 0; i < 3; i++ {
+        parent = mineOn(t, chain, parent, addr, reward)
+        if err := chain.AddBlock(parent); err != nil {
+            t.Fatal(err)
+        }
+    }
+    headers := sync()
+    if len(headers) != 3 || headers[0].Height != 1 {
+        t.Fatalf("got %d headers after the reorganization, want the 3 above the fork", len(headers))
+    }
+    if !bytes.Equal(light.LastHash, chain.LastHash) {
+        t.Errorf("light tip is %x, want %x", light.LastHash, chain.LastHash)
+    }
+    if headers := sync(); len(headers) != 0 {
+        t.Errorf("got %d headers from a synced locator", len(headers))
+    }
+}
@@ -1,10 +1,10 @@
 package blockchain
 
-import "github.com/dgraph-io/badger"
+import "github.com/viscory/reciprocus/storage"
 
 type BlockChainIterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	Database    storage.Store
 }
 
 func (chain *BlockChain) Iterator() *BlockChainIterator {
@@ -13,20 +13,38 @@ func (chain *BlockChain) Iterator() *BlockChainIterator {
 	return iter
 }
 
-func (iter *BlockChainIterator) Next() *Block {
+func (iter *BlockChainIterator) Next() (*Block, error) {
 	var block *Block
 
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		Handle(err)
-		encodedBlock, err := item.Value()
-		block = Deserialize(encodedBlock)
+	err := iter.Database.View(func(txn storage.Txn) error {
+		var err error
+		block, err = getBlock(txn, iter.CurrentHash)
 
 		return err
 	})
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
 	iter.CurrentHash = block.PrevHash
 
-	return block
+	return block, nil
+}
+
+func (iter *BlockChainIterator) NextHeader() (*BlockHeader, error) {
+	var header *BlockHeader
+
+	err := iter.Database.View(func(txn storage.Txn) error {
+		var err error
+		header, err = getHeader(txn, iter.CurrentHash)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	iter.CurrentHash = header.PrevHash
+
+	return header, nil
 }
@@ -0,0 +1,41 @@
+package blockchain
+
+import (
+    "errors"
+    "fmt"
+
+    "github.com/viscory/reciprocus/codec"
+)
+
+const EncodingVersion = 1
+
+var (
+    formatKey = []byte("format")
+
+    ErrEncodingVersion = errors.New("unsupported encoding version")
+)
+
+func newWriter() *codec.Writer {
+    w := codec.NewWriter()
+    w.PutUint8(EncodingVersion)
+    return w
+}
+
+func newReader(data []byte, what string) (*codec.Reader, error) {
+    r := codec.NewReader(data)
+    version := r.Uint8()
+    if err := r.Err(); err != nil {
+        return nil, fmt.Errorf("%w: %s: %s", ErrCorruptData, what, err)
+    }
+    if version != EncodingVersion {
+        return nil, fmt.Errorf("%w: %s: %d", ErrEncodingVersion, what, version)
+    }
+    return r, nil
+}
+
+func finish(r *codec.Reader, what string) error {
+    if err := r.Finish(); err != nil {
+        return fmt.Errorf("%w: %s: %s", ErrCorruptData, what, err)
+    }
+    return nil
+}
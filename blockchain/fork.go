@@ -0,0 +1,208 @@
+package blockchain
+
+import (
+    "bytes"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "math/big"
+
+    "github.com/viscory/reciprocus/storage"
+)
+
+var (
+    workPrefix = []byte("work-")
+    invalidPrefix = []byte("invalid-")
+)
+
+func (chain *BlockChain) GetChainWork(blockHash []byte) (*big.Int, error) {
+    work := new(big.Int)
+    hash := blockHash
+
+    for {
+        var stored []byte
+        err := chain.Database.View(func(txn storage.Txn) error {
+            var err error
+            stored, err = txn.Get(append(workPrefix, hash...))
+            if err == storage.ErrNotFound {
+                return nil
+            }
+            return err
+        })
+        if err != nil {
+            return nil, err
+        }
+        if stored != nil {
+            return work.Add(work, new(big.Int).SetBytes(stored)), nil
+        }
+
+        header, err := chain.GetHeader(hash)
+        if err != nil {
+            return nil, err
+        }
+        work.Add(work, NewProof(&header).Work())
+        if len(header.PrevHash) == 0 {
+            return work, nil
+        }
+        hash = header.PrevHash
+    }
+}
+
+func (chain *BlockChain) storeBlock(block *Block, work *big.Int) error {
+    return chain.Database.Update(func(txn storage.Txn) error {
+        return putBlock(txn, block, work.Bytes())
+    })
+}
+
+func (chain *BlockChain) isInvalid(hash []byte) bool {
+    err := chain.Database.View(func(txn storage.Txn) error {
+        _, err := txn.Get(append(invalidPrefix, hash...))
+        return err
+    })
+    return err == nil
+}
+
+func (chain *BlockChain) invalidateBlocks(blocks []*Block) error {
+    return chain.Database.Update(func(txn storage.Txn) error {
+        for _, block := range blocks {
+            if err := txn.Put(append(invalidPrefix, block.Hash...), []byte{}); err != nil {
+                return err
+            }
+            for _, prefix := range [][]byte{headerPrefix, blockPrefix, workPrefix} {
+                if err := txn.Delete(append(prefix, block.Hash...)); err != nil {
+                    return err
+                }
+            }
+        }
+        return nil
+    })
+}
+
+func (chain *BlockChain) connectBlock(txn storage.Txn, block *Block) error {
+    UTXOSet := UTXOSet{Blockchain: chain}
+    if err := UTXOSet.update(txn, block); err != nil {
+        return err
+    }
+    if err := txn.Put(heightKey(block.Height), block.Hash); err != nil {
+        return err
+    }
+    if chain.TxIndex {
+        if err := indexTransactions(txn, block); err != nil {
+            return err
+        }
+    }
+    return txn.Put([]byte("lh"), block.Hash)
+}
+
+func (chain *BlockChain) disconnectBlock(txn storage.Txn, block *Block) error {
+    UTXOSet := UTXOSet{Blockchain: chain}
+    if err := UTXOSet.disconnect(txn, block); err != nil {
+        return err
+    }
+    if err := txn.Delete(heightKey(block.Height)); err != nil {
+        return err
+    }
+    if chain.TxIndex {
+        if err := unindexTransactions(txn, block); err != nil {
+            return err
+        }
+    }
+    return txn.Put([]byte("lh"), block.PrevHash)
+}
+
+func (chain *BlockChain) findFork(oldTip, newTip *Block) ([]*Block, []*Block, error) {
+    var detach, attach []*Block
+
+    for !bytes.Equal(oldTip.Hash, newTip.Hash) {
+        if oldTip.Height >= newTip.Height {
+            detach = append(detach, oldTip)
+            parent, err := chain.GetBlock(oldTip.PrevHash)
+            if err != nil {
+                return nil, nil, err
+            }
+            oldTip = &parent
+        } else {
+            attach = append([]*Block{newTip}, attach...)
+            if chain.isInvalid(newTip.PrevHash) {
+                return nil, attach, fmt.Errorf("%w: %x", ErrInvalidBranch, newTip.PrevHash)
+            }
+            parent, err := chain.GetBlock(newTip.PrevHash)
+            if err != nil {
+                return nil, nil, err
+            }
+            newTip = &parent
+        }
+    }
+    return detach, attach, nil
+}
+
+func (chain *BlockChain) reorganize(newTip *Block) error {
+    oldTip, err := chain.GetBlock(chain.LastHash)
+    if err != nil {
+        return err
+    }
+    detach, attach, err := chain.findFork(&oldTip, newTip)
+    if errors.Is(err, ErrInvalidBranch) {
+        if err := chain.invalidateBlocks(attach); err != nil {
+            return err
+        }
+        return fmt.Errorf("reorganization to %x failed: %w", newTip.Hash, err)
+    }
+    if err != nil {
+        return err
+    }
+
+    failed := -1
+    err = chain.Database.Update(func(txn storage.Txn) error {
+        for _, block := range detach {
+            if err := chain.disconnectBlock(txn, block); err != nil {
+                return err
+            }
+        }
+        for i, block := range attach {
+            if err := chain.checkBlockTransactions(txn, block); err != nil {
+                failed = i
+                return err
+            }
+            if err := chain.connectBlock(txn, block); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if failed >= 0 {
+        if err := chain.invalidateBlocks(attach[failed:]); err != nil {
+            return err
+        }
+        return fmt.Errorf("reorganization to %x failed: %w", newTip.Hash, err)
+    }
+    if err != nil {
+        return err
+    }
+    chain.LastHash = newTip.Hash
+
+    fmt.Printf("Reorganized chain: disconnected %d blocks, connected %d\n", len(detach), len(attach))
+
+    if chain.OnConnectedBlock != nil {
+        for _, block := range attach {
+            chain.OnConnectedBlock(block)
+        }
+    }
+
+    if chain.OnOrphanedTx != nil {
+        included := make(map[string]bool)
+        for _, block := range attach {
+            for _, tx := range block.Transactions {
+                included[hex.EncodeToString(tx.ID)] = true
+            }
+        }
+        for _, block := range detach {
+            for _, tx := range block.Transactions {
+                if !tx.IsCoinBase() && !included[hex.EncodeToString(tx.ID)] {
+                    chain.OnOrphanedTx(tx)
+                }
+            }
+        }
+    }
+    return nil
+}
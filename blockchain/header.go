@@ -0,0 +1,218 @@
+package blockchain
+
+import (
+    "errors"
+    "fmt"
+
+    "github.com/viscory/reciprocus/codec"
+    "github.com/viscory/reciprocus/storage"
+)
+
+var (
+    headerPrefix = []byte("header-")
+    blockPrefix = []byte("block-")
+    heightPrefix = []byte("height-")
+
+    ErrHeaderNotFound = errors.New("header is not found")
+    ErrBlockNotFound = errors.New("block is not found")
+    ErrCorruptData = errors.New("corrupt data")
+)
+
+type BlockHeader struct {
+    Version int
+    Timestamp int64
+    Hash []byte
+    PrevHash []byte
+    MerkleRoot []byte
+    Nonce int
+    Height int
+    Difficulty int
+    Sincerity int
+}
+
+func (h *BlockHeader) encode(w *codec.Writer) {
+    w.PutUint32(uint32(h.Version))
+    w.PutInt64(h.Timestamp)
+    w.PutBytes(h.Hash)
+    w.PutBytes(h.PrevHash)
+    w.PutBytes(h.MerkleRoot)
+    w.PutInt64(int64(h.Nonce))
+    w.PutUint64(uint64(h.Height))
+    w.PutUint32(uint32(h.Difficulty))
+    w.PutUint32(uint32(h.Sincerity))
+}
+
+func (h *BlockHeader) HashData(nonce int) []byte {
+    w := newWriter()
+    w.PutUint32(uint32(h.Version))
+    w.PutInt64(h.Timestamp)
+    w.PutBytes(h.PrevHash)
+    w.PutBytes(h.MerkleRoot)
+    w.PutInt64(int64(nonce))
+    w.PutUint64(uint64(h.Height))
+    w.PutUint32(uint32(h.Difficulty))
+    w.PutUint32(uint32(h.Sincerity))
+    return w.Bytes()
+}
+
+func decodeHeader(r *codec.Reader) BlockHeader {
+    var h BlockHeader
+    h.Version = int(r.Uint32())
+    h.Timestamp = r.Int64()
+    h.Hash = r.Bytes()
+    h.PrevHash = r.Bytes()
+    h.MerkleRoot = r.Bytes()
+    h.Nonce = int(r.Int64())
+    h.Height = int(r.Uint64())
+    h.Difficulty = int(r.Uint32())
+    h.Sincerity = int(r.Uint32())
+    return h
+}
+
+func (h *BlockHeader) Serialize() []byte {
+    w := newWriter()
+    h.encode(w)
+    return w.Bytes()
+}
+
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+    r, err := newReader(data, "header")
+    if err != nil {
+        return nil, err
+    }
+    header := decodeHeader(r)
+    if err := finish(r, "header"); err != nil {
+        return nil, err
+    }
+    return &header, nil
+}
+
+func serializeBody(txs []*Transaction) []byte {
+    w := newWriter()
+    encodeTransactions(w, txs)
+    return w.Bytes()
+}
+
+func deserializeBody(data []byte) ([]*Transaction, error) {
+    r, err := newReader(data, "block body")
+    if err != nil {
+        return nil, err
+    }
+    txs := decodeTransactions(r)
+    if err := finish(r, "block body"); err != nil {
+        return nil, err
+    }
+    return txs, nil
+}
+
+func getHeader(txn storage.Txn, hash []byte) (*BlockHeader, error) {
+    data, err := txn.Get(append(headerPrefix, hash...))
+    if err == storage.ErrNotFound {
+        return nil, ErrHeaderNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    return DeserializeHeader(data)
+}
+
+func getBlock(txn storage.Txn, hash []byte) (*Block, error) {
+    header, err := getHeader(txn, hash)
+    if err == ErrHeaderNotFound {
+        return nil, ErrBlockNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    data, err := txn.Get(append(blockPrefix, hash...))
+    if err == storage.ErrNotFound {
+        return nil, ErrBlockNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    txs, err := deserializeBody(data)
+    if err != nil {
+        return nil, err
+    }
+    return &Block{*header, txs}, nil
+}
+
+func putHeader(txn storage.Txn, header *BlockHeader, work []byte) error {
+    if err := txn.Put(append(headerPrefix, header.Hash...), header.Serialize()); err != nil {
+        return err
+    }
+    return txn.Put(append(workPrefix, header.Hash...), work)
+}
+
+func putBlock(txn storage.Txn, block *Block, work []byte) error {
+    if err := putHeader(txn, &block.BlockHeader, work); err != nil {
+        return err
+    }
+    return txn.Put(append(blockPrefix, block.Hash...), serializeBody(block.Transactions))
+}
+
+func (chain *BlockChain) GetHeader(hash []byte) (BlockHeader, error) {
+    var header BlockHeader
+    err := chain.Database.View(func(txn storage.Txn) error {
+        h, err := getHeader(txn, hash)
+        if err != nil {
+            return err
+        }
+        header = *h
+        return nil
+    })
+    return header, err
+}
+
+func (chain *BlockChain) HasBlock(hash []byte) bool {
+    err := chain.Database.View(func(txn storage.Txn) error {
+        _, err := txn.Get(append(blockPrefix, hash...))
+        return err
+    })
+    return err == nil
+}
+
+func (chain *BlockChain) AddHeader(header *BlockHeader) error {
+    if _, err := chain.GetHeader(header.Hash); err == nil {
+        return nil
+    }
+    if err := CheckHeader(header); err != nil {
+        return err
+    }
+    if err := chain.checkHeaderContext(header); err != nil {
+        return err
+    }
+
+    parentWork, err := chain.GetChainWork(header.PrevHash)
+    if err != nil {
+        return err
+    }
+    work := parentWork.Add(parentWork, NewProof(header).Work())
+
+    return chain.Database.Update(func(txn storage.Txn) error {
+        return putHeader(txn, header, work.Bytes())
+    })
+}
+
+func heightKey(height int) []byte {
+    return append(heightPrefix, ToHex(int64(height))...)
+}
+
+func (chain *BlockChain) GetBlockHashByHeight(height int) ([]byte, error) {
+    var hash []byte
+    err := chain.Database.View(func(txn storage.Txn) error {
+        var err error
+        hash, err = txn.Get(heightKey(height))
+        if err == storage.ErrNotFound {
+            return fmt.Errorf("%w: no block at height %d", ErrBlockNotFound, height)
+        }
+        return err
+    })
+    return hash, err
+}
+
+func (chain *BlockChain) GetBlockByHeight(height int) (Block, error) {
+    hash, err := chain.GetBlockHashByHeight(height)
+    if err != nil {
+        return Block{}, err
+    }
+    return chain.GetBlock(hash)
+}
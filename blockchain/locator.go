@@ -0,0 +1,62 @@
+package blockchain
+
+const (
+    MaxInvBlocks = 500
+    locatorDenseHashes = 10
+)
+
+func (chain *BlockChain) BlockLocator() ([][]byte, error) {
+    if chain.LastHash == nil {
+        return nil, nil
+    }
+    bestHeight, err := chain.GetBestHeight()
+    if err != nil {
+        return nil, err
+    }
+
+    var locator [][]byte
+    step := 1
+    for height := bestHeight; height > 0; height -= step {
+        hash, err := chain.GetBlockHashByHeight(height)
+        if err != nil {
+            return nil, err
+        }
+        locator = append(locator, hash)
+        if len(locator) >= locatorDenseHashes {
+            step *= 2
+        }
+    }
+
+    genesis, err := chain.GetBlockHashByHeight(0)
+    if err != nil {
+        return nil, err
+    }
+    return append(locator, genesis), nil
+}
+
+func (chain *BlockChain) locateFork(locator [][]byte) int {
+    for _, hash := range locator {
+        if header, err := chain.onMainChain(hash); err == nil {
+            return header.Height + 1
+        }
+    }
+    return 1
+}
+
+func (chain *BlockChain) LocateBlocks(locator [][]byte) ([][]byte, error) {
+    start := chain.locateFork(locator)
+    bestHeight, err := chain.GetBestHeight()
+    if err != nil {
+        return nil, err
+    }
+
+    var hashes [][]byte
+    for height := start; height <= bestHeight && len(hashes) < MaxInvBlocks; height++ {
+        hash, err := chain.GetBlockHashByHeight(height)
+        if err != nil {
+            return nil, err
+        }
+        hashes = append(hashes, hash)
+    }
+    return hashes, nil
+}
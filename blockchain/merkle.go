@@ -1,9 +1,17 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+    "bytes"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+)
+
+var ErrBadProofIndex = errors.New("merkle proof index is out of range")
 
 type MerkleTree struct {
     RootNode *MerkleNode
+    leaves int
 }
 
 type MerkleNode struct {
@@ -12,6 +20,11 @@ type MerkleNode struct {
     Data []byte
 }
 
+type MerkleProof struct {
+    Index int
+    Hashes [][]byte
+}
+
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
     node := MerkleNode{}
 
@@ -19,9 +32,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
         hash := sha256.Sum256(data)
         node.Data = hash[:]
     } else {
-        prevHashes := append(left.Data, right.Data ...)
-        hash := sha256.Sum256(prevHashes)
-        node.Data = hash[:]
+        node.Data = hashPair(left.Data, right.Data)
     }
 
     node.Left = left
@@ -30,26 +41,79 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
     return &node
 }
 
+func hashPair(left, right []byte) []byte {
+    prevHashes := append(append([]byte{}, left...), right...)
+    hash := sha256.Sum256(prevHashes)
+    return hash[:]
+}
+
 func NewMerkleTree(data [][]byte) *MerkleTree {
-    var nodes []MerkleNode
+    var nodes []*MerkleNode
 
-    if len(data)%2 != 0 {
-        data = append(data, data[len(data)-1])
-    }
-    
     for _, dat := range data {
-        node := NewMerkleNode(nil, nil, dat)
-        nodes = append(nodes, *node)
+        nodes = append(nodes, NewMerkleNode(nil, nil, dat))
     }
-    for i:=0; i<len(data)/2; i++ {
-        var level []MerkleNode
+    if len(nodes) == 0 {
+        nodes = append(nodes, NewMerkleNode(nil, nil, nil))
+    }
+
+    for {
+        if len(nodes)%2 != 0 {
+            nodes = append(nodes, nodes[len(nodes)-1])
+        }
 
-        for j:=0; j<len(nodes); j+=2 {
-            node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
-            level = append(level, *node)
+        var level []*MerkleNode
+        for j := 0; j < len(nodes); j += 2 {
+            level = append(level, NewMerkleNode(nodes[j], nodes[j+1], nil))
         }
         nodes = level
+
+        if len(nodes) == 1 {
+            break
+        }
+    }
+    return &MerkleTree{nodes[0], len(data)}
+}
+
+func (t *MerkleTree) Proof(txIndex int) (MerkleProof, error) {
+    if txIndex < 0 || txIndex >= t.leaves {
+        return MerkleProof{}, fmt.Errorf("%w: %d of %d", ErrBadProofIndex, txIndex, t.leaves)
+    }
+
+    depth := 0
+    for node := t.RootNode; node.Left != nil; node = node.Left {
+        depth++
+    }
+
+    hashes := make([][]byte, depth)
+    node := t.RootNode
+    for level := depth - 1; level >= 0; level-- {
+        if (txIndex>>uint(level))&1 == 0 {
+            hashes[level] = node.Right.Data
+            node = node.Left
+        } else {
+            hashes[level] = node.Left.Data
+            node = node.Right
+        }
+    }
+    return MerkleProof{txIndex, hashes}, nil
+}
+
+func VerifyMerkleProof(root, leaf []byte, proof MerkleProof) bool {
+    if proof.Index < 0 || proof.Index >= 1<<uint(len(proof.Hashes)) {
+        return false
+    }
+
+    hash := sha256.Sum256(leaf)
+    current := hash[:]
+    index := proof.Index
+    for _, sibling := range proof.Hashes {
+        if index%2 == 0 {
+            current = hashPair(current, sibling)
+        } else {
+            current = hashPair(sibling, current)
+        }
+        index /= 2
     }
-    tree := MerkleTree{&nodes[0]}
-    return &tree
+    return bytes.Equal(current, root)
 }
@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "testing"
+)
+
+func TestMerkleTreeRootsAndProofs(t *testing.T) {
+    var leaves [][]byte
+    var h [][]byte
+    for i := 0; i < 8; i++ {
+        leaf := []byte(fmt.Sprintf("tx %d", i))
+        hash := sha256.Sum256(leaf)
+        leaves = append(leaves, leaf)
+        h = append(h, hash[:])
+    }
+    p := hashPair
+    p01, p23 := p(h[0], h[1]), p(h[2], h[3])
+
+    tests := []struct {
+        leaves int
+        root []byte
+    }{
+        {1, p(h[0], h[0])},
+        {2, p01},
+        {3, p(p01, p(h[2], h[2]))},
+        {4, p(p01, p23)},
+        {5, p(p(p01, p23), p(p(h[4], h[4]), p(h[4], h[4])))},
+        {6, p(p(p01, p23), p(p(h[4], h[5]), p(h[4], h[5])))},
+        {7, p(p(p01, p23), p(p(h[4], h[5]), p(h[6], h[6])))},
+        {8, p(p(p01, p23), p(p(h[4], h[5]), p(h[6], h[7])))},
+    }
+    for _, test := range tests {
+        tree := NewMerkleTree(leaves[:test.leaves])
+        root := tree.RootNode.Data
+        if !bytes.Equal(root, test.root) {
+            t.Errorf("%d leaves: root %x, want %x", test.leaves, root, test.root)
+            continue
+        }
+
+        for i := 0; i < test.leaves; i++ {
+            proof, err := tree.Proof(i)
+            if err != nil {
+                t.Fatalf("%d leaves: proof of %d: %v", test.leaves, i, err)
+            }
+            if !VerifyMerkleProof(root, leaves[i], proof) {
+                t.Errorf("%d leaves: proof of %d does not verify", test.leaves, i)
+            }
+            other := leaves[(i+1)%test.leaves]
+            if test.leaves > 1 && VerifyMerkleProof(root, other, proof) {
+                t.Errorf("%d leaves: proof of %d verifies another leaf", test.leaves, i)
+            }
+        }
+        if _, err := tree.Proof(test.leaves); !errors.Is(err, ErrBadProofIndex) {
+            t.Errorf("%d leaves: proof past the last leaf returned %v", test.leaves, err)
+        }
+    }
+}
@@ -0,0 +1,295 @@
+package blockchain
+
+import (
+    "bytes"
+    "context"
+    "encoding/gob"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "os"
+    "runtime"
+
+    "github.com/viscory/reciprocus/storage"
+    "github.com/viscory/reciprocus/wallet"
+)
+
+const (
+    migratingSuffix = ".migrating"
+    legacySuffix = ".legacy"
+)
+
+var (
+    ErrLegacyFormat = errors.New("database was written by an older release, run migratedb")
+    ErrMissingKey = errors.New("no wallet key to re-sign a legacy transaction")
+)
+
+type legacyBlock struct {
+    Version int
+    Timestamp int64
+    Hash []byte
+    PrevHash []byte
+    MerkleRoot []byte
+    Nonce int
+    Height int
+    Difficulty int
+    Sincerity int
+    Transactions []*Transaction
+}
+
+type legacyBody struct {
+    Transactions []*Transaction
+}
+
+func checkFormat(db storage.Store) error {
+    return db.View(func(txn storage.Txn) error {
+        format, err := txn.Get(formatKey)
+        if err == storage.ErrNotFound {
+            return ErrLegacyFormat
+        } else if err != nil {
+            return err
+        }
+        if len(format) != 1 || format[0] != EncodingVersion {
+            return fmt.Errorf("%w: database format %x", ErrEncodingVersion, format)
+        }
+        return nil
+    })
+}
+
+func MigrateBlockChain(dataDir, nodeId, network string, wallets map[string]*wallet.Wallet) (int, error) {
+    params, err := LookupNetwork(network)
+    if err != nil {
+        return 0, err
+    }
+    path := chainPath(dataDir, nodeId, params)
+    if !storage.BadgerExists(path) {
+        return 0, ErrNoBlockChain
+    }
+
+    legacy, err := storage.OpenBadger(path)
+    if err != nil {
+        return 0, err
+    }
+    count, err := migrateInto(legacy, path+migratingSuffix, network, wallets)
+    legacy.Close()
+    if err != nil || count == 0 {
+        return 0, err
+    }
+
+    if err := os.Rename(path, path+legacySuffix); err != nil {
+        return 0, err
+    }
+    if err := os.Rename(path+migratingSuffix, path); err != nil {
+        return 0, err
+    }
+    fmt.Printf("Kept the legacy database in %s\n", path+legacySuffix)
+    return count, nil
+}
+
+func migrateInto(legacy storage.Store, dir, network string, wallets map[string]*wallet.Wallet) (int, error) {
+    if err := checkFormat(legacy); err != ErrLegacyFormat {
+        return 0, err
+    }
+    stored, err := loadNetwork(legacy)
+    if err != nil {
+        return 0, err
+    }
+    if stored != network {
+        return 0, fmt.Errorf("%w: holds a %s chain", ErrWrongNetwork, stored)
+    }
+    txIndex, err := loadTxIndex(legacy)
+    if err != nil {
+        return 0, err
+    }
+
+    if err := os.RemoveAll(dir); err != nil {
+        return 0, err
+    }
+    db, err := storage.OpenBadger(dir)
+    if err != nil {
+        return 0, err
+    }
+    count := 0
+    chain, err := NewBlockChain(db, network, txIndex)
+    if err == nil {
+        count, err = MigrateDatabase(legacy, chain, wallets)
+    }
+    db.Close()
+    if err != nil {
+        os.RemoveAll(dir)
+        return 0, err
+    }
+    return count, nil
+}
+
+func MigrateDatabase(legacy storage.Store, chain *BlockChain, wallets map[string]*wallet.Wallet) (int, error) {
+    blocks, err := readLegacyChain(legacy)
+    if err != nil {
+        return 0, err
+    }
+    keys := make(map[string]*wallet.Wallet)
+    for _, w := range wallets {
+        keys[hex.EncodeToString(wallet.PublicKeyHash(w.PublicKey))] = w
+    }
+
+    ids := make(map[string][]byte)
+    prevTXs := make(map[string]Transaction)
+    parent, err := chain.GetHeader(chain.LastHash)
+    if err != nil {
+        return 0, err
+    }
+    for _, old := range blocks {
+        var txs []*Transaction
+        for _, legacyTx := range old.Transactions {
+            tx, err := replayTransaction(legacyTx, ids, prevTXs, keys)
+            if err != nil {
+                return 0, fmt.Errorf("legacy block %d: %w", old.Height, err)
+            }
+            ids[hex.EncodeToString(legacyTx.ID)] = tx.ID
+            prevTXs[hex.EncodeToString(tx.ID)] = *tx
+            txs = append(txs, tx)
+        }
+
+        difficulty, err := chain.NextDifficulty(&parent)
+        if err != nil {
+            return 0, err
+        }
+        block := NewBlock(txs, parent.Hash, parent.Height+1, difficulty, old.Sincerity)
+        block.Timestamp = old.Timestamp
+        if block.Timestamp < parent.Timestamp {
+            block.Timestamp = parent.Timestamp
+        }
+        if _, err := block.Mine(context.Background(), runtime.NumCPU()); err != nil {
+            return 0, err
+        }
+        if err := chain.AddBlock(block); err != nil {
+            return 0, fmt.Errorf("legacy block %d (%x): %w", old.Height, old.Hash, err)
+        }
+        parent = block.BlockHeader
+    }
+    return len(blocks), nil
+}
+
+func replayTransaction(legacy *Transaction, ids map[string][]byte, prevTXs map[string]Transaction, keys map[string]*wallet.Wallet) (*Transaction, error) {
+    tx := Transaction{
+        Inputs: append([]TxInput{}, legacy.Inputs...),
+        Outputs: append([]TxOutput{}, legacy.Outputs...),
+    }
+    if tx.IsCoinBase() {
+        tx.ID = tx.Hash()
+        return &tx, nil
+    }
+
+    var signer *wallet.Wallet
+    for i, in := range tx.Inputs {
+        ID, ok := ids[hex.EncodeToString(in.ID)]
+        if !ok {
+            return nil, fmt.Errorf("%w: tx %x spends %x", ErrMissingPrevTx, legacy.ID, in.ID)
+        }
+        tx.Inputs[i].ID = ID
+        tx.Inputs[i].Signature = nil
+
+        w, ok := keys[hex.EncodeToString(wallet.PublicKeyHash(in.PubKey))]
+        if !ok {
+            return nil, fmt.Errorf("%w: tx %x", ErrMissingKey, legacy.ID)
+        }
+        if signer != nil && signer != w {
+            return nil, fmt.Errorf("%w: tx %x spends outputs of several wallets", ErrMissingKey, legacy.ID)
+        }
+        signer = w
+    }
+    if err := tx.Sign(signer.PrivateKey, prevTXs); err != nil {
+        return nil, err
+    }
+    return &tx, nil
+}
+
+func readLegacyChain(db storage.Store) ([]*legacyBlock, error) {
+    var blocks []*legacyBlock
+    err := db.View(func(txn storage.Txn) error {
+        hash, err := txn.Get([]byte("lh"))
+        if err == storage.ErrNotFound {
+            return ErrNoBlockChain
+        } else if err != nil {
+            return err
+        }
+        split := true
+        if _, err := txn.Get(legacyKey(headerPrefix, hash)); err == storage.ErrNotFound {
+            split = false
+        } else if err != nil {
+            return err
+        }
+
+        for len(hash) > 0 {
+            block, err := readLegacyBlock(txn, hash, split)
+            if err != nil {
+                return err
+            }
+            if n := len(blocks); n > 0 && block.Height != blocks[n-1].Height-1 {
+                return fmt.Errorf("%w: legacy block %x is at height %d below height %d", ErrCorruptData, hash, block.Height, blocks[n-1].Height)
+            }
+            blocks = append(blocks, block)
+            hash = block.PrevHash
+        }
+        if len(blocks) == 0 || blocks[len(blocks)-1].Height != 0 {
+            return fmt.Errorf("%w: legacy chain does not reach its genesis", ErrCorruptData)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+        blocks[i], blocks[j] = blocks[j], blocks[i]
+    }
+    return blocks, nil
+}
+
+func readLegacyBlock(txn storage.Txn, hash []byte, split bool) (*legacyBlock, error) {
+    var block legacyBlock
+    if !split {
+        data, err := getLegacy(txn, hash)
+        if err != nil {
+            return nil, err
+        }
+        return &block, decodeLegacy(data, &block)
+    }
+
+    data, err := getLegacy(txn, legacyKey(headerPrefix, hash))
+    if err != nil {
+        return nil, err
+    }
+    if err := decodeLegacy(data, &block); err != nil {
+        return nil, err
+    }
+    data, err = getLegacy(txn, legacyKey(blockPrefix, hash))
+    if err != nil {
+        return nil, err
+    }
+    var body legacyBody
+    if err := decodeLegacy(data, &body); err != nil {
+        return nil, err
+    }
+    block.Transactions = body.Transactions
+    return &block, nil
+}
+
+func legacyKey(prefix, hash []byte) []byte {
+    return append(append([]byte{}, prefix...), hash...)
+}
+
+func getLegacy(txn storage.Txn, key []byte) ([]byte, error) {
+    data, err := txn.Get(key)
+    if err == storage.ErrNotFound {
+        return nil, fmt.Errorf("%w: legacy record %x is missing", ErrCorruptData, key)
+    }
+    return data, err
+}
+
+func decodeLegacy(data []byte, v interface{}) error {
+    if err := gob.NewDecoder(bytes.NewReader(data)).Decode(v); err != nil {
+        return fmt.Errorf("%w: legacy %T: %s", ErrCorruptData, v, err)
+    }
+    return nil
+}
@@ -0,0 +1,121 @@
+package blockchain
+
+import (
+    "bytes"
+    "encoding/gob"
+    "errors"
+    "testing"
+
+    "github.com/viscory/reciprocus/storage"
+    "github.com/viscory/reciprocus/wallet"
+)
+
+func gobEncode(t *testing.T, v interface{}) []byte {
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+func putLegacyChain(t *testing.T, db storage.Store, split bool, blocks []legacyBlock) {
+    err := db.Update(func(txn storage.Txn) error {
+        for i := range blocks {
+            block := blocks[i]
+            if !split {
+                if err := txn.Put(block.Hash, gobEncode(t, block)); err != nil {
+                    return err
+                }
+                continue
+            }
+            header := BlockHeader{block.Version, block.Timestamp, block.Hash, block.PrevHash, block.MerkleRoot, block.Nonce, block.Height, block.Difficulty, block.Sincerity}
+            if err := txn.Put(legacyKey(headerPrefix, block.Hash), gobEncode(t, header)); err != nil {
+                return err
+            }
+            if err := txn.Put(legacyKey(blockPrefix, block.Hash), gobEncode(t, legacyBody{block.Transactions})); err != nil {
+                return err
+            }
+        }
+        return txn.Put([]byte("lh"), blocks[len(blocks)-1].Hash)
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestMigrateDatabaseReplaysLegacyChain(t *testing.T) {
+    from, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    to, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    params, err := LookupNetwork("regtest")
+    if err != nil {
+        t.Fatal(err)
+    }
+    version := params.AddressVersion
+    fromAddr, toAddr := string(from.VersionedAddress(version)), string(to.VersionedAddress(version))
+    reward := params.BlockReward(0)
+
+    coinbase, err := CoinbaseTx(fromAddr, "", reward)
+    if err != nil {
+        t.Fatal(err)
+    }
+    coinbase.ID = []byte("legacy coinbase")
+    payment, err := NewTxOutput(100, toAddr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    change, err := NewTxOutput(reward-101, fromAddr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    spend := &Transaction{
+        ID: []byte("legacy spend"),
+        Inputs: []TxInput{{coinbase.ID, 0, []byte("gob signature"), from.PublicKey}},
+        Outputs: []TxOutput{*payment, *change},
+    }
+    reward1, err := CoinbaseTx(fromAddr, "", reward+1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    blocks := []legacyBlock{
+        {Timestamp: 1, Hash: []byte("legacy genesis"), Transactions: []*Transaction{coinbase}},
+        {Timestamp: 2, Hash: []byte("legacy block 1"), PrevHash: []byte("legacy genesis"), Height: 1, Transactions: []*Transaction{reward1, spend}},
+    }
+
+    for _, split := range []bool{false, true} {
+        legacy := storage.NewMemory()
+        putLegacyChain(t, legacy, split, blocks)
+        chain := newTestChain(t)
+        wallets := map[string]*wallet.Wallet{fromAddr: from}
+
+        count, err := MigrateDatabase(legacy, chain, wallets)
+        if err != nil {
+            t.Fatalf("split layout %v: %v", split, err)
+        }
+        height, err := chain.GetBestHeight()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if count != 2 || height != 2 {
+            t.Errorf("split layout %v: migrated %d blocks to height %d, want 2 and 2", split, count, height)
+        }
+        UTXOSet := UTXOSet{Blockchain: chain}
+        outs, err := UTXOSet.FindUTXO(wallet.PublicKeyHash(to.PublicKey))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(outs) != 1 || outs[0].Value != 100 {
+            t.Errorf("split layout %v: recipient outputs = %v, want one of 100", split, outs)
+        }
+
+        _, err = MigrateDatabase(legacy, newTestChain(t), nil)
+        if !errors.Is(err, ErrMissingKey) {
+            t.Errorf("split layout %v: migration without the spender's key returned %v", split, err)
+        }
+    }
+}
@@ -0,0 +1,180 @@
+package blockchain
+
+import (
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "math"
+    "path/filepath"
+
+    "github.com/viscory/reciprocus/storage"
+)
+
+const DefaultNetwork = "main"
+
+type GenesisParams struct {
+    Timestamp int64
+    Nonce int
+    Data string
+    PubKeyHash string
+    Hash string
+}
+
+type ChainParams struct {
+    Name string
+    Genesis GenesisParams
+    Reward int
+    MaxMoney int
+    Retarget RetargetParams
+    AddressVersion byte
+    Magic uint32
+    DefaultPort int
+    Seeds []string
+}
+
+var Networks = map[string]ChainParams{
+    "main": {
+        Name: "main",
+        Genesis: GenesisParams{
+            Timestamp: 1792281600,
+            Nonce: 131002,
+            Data: "First transaction",
+            PubKeyHash: "0000000000000000000000000000000000000000",
+            Hash: "000012de027ffb617ecbfe834470d87b166446e8874b0a9898b3f2cd9a24fe4a",
+        },
+        Reward: 4096,
+        MaxMoney: 1 << 50,
+        Retarget: RetargetParams{
+            InitialDifficulty: 18,
+            MinDifficulty: 12,
+            MaxDifficulty: 240,
+            Interval: 64,
+            TargetSpacing: 60,
+            MaxAdjustment: 2,
+        },
+        AddressVersion: 0x00,
+        Magic: 0x7263706d,
+        DefaultPort: 3000,
+        Seeds: []string{"localhost:3000"},
+    },
+    "staging": {
+        Name: "staging",
+        Genesis: GenesisParams{
+            Timestamp: 1792281600,
+            Nonce: 45791,
+            Data: "First staging transaction",
+            PubKeyHash: "0000000000000000000000000000000000000000",
+            Hash: "0002c60675eabaa2cc6333b3a5178054d92108b45885a5c78bc74d830646d4b3",
+        },
+        Reward: 4096,
+        MaxMoney: 1 << 50,
+        Retarget: RetargetParams{
+            InitialDifficulty: 14,
+            MinDifficulty: 8,
+            MaxDifficulty: 240,
+            Interval: 16,
+            TargetSpacing: 15,
+            MaxAdjustment: 2,
+        },
+        AddressVersion: 0x6f,
+        Magic: 0x72637073,
+        DefaultPort: 13000,
+        Seeds: []string{"localhost:13000"},
+    },
+    "regtest": {
+        Name: "regtest",
+        Genesis: GenesisParams{
+            Timestamp: 1792281600,
+            Nonce: 47,
+            Data: "First regtest transaction",
+            PubKeyHash: "0000000000000000000000000000000000000000",
+            Hash: "008ce64a80dbf8edd16e87298b26a6958670b52d5174639adae552d7125acf36",
+        },
+        Reward: 4096,
+        MaxMoney: 1 << 50,
+        Retarget: RetargetParams{
+            InitialDifficulty: 8,
+            MinDifficulty: 1,
+            MaxDifficulty: 240,
+            Interval: 0,
+            TargetSpacing: 1,
+            MaxAdjustment: 0,
+        },
+        AddressVersion: 0x6f,
+        Magic: 0x72637072,
+        DefaultPort: 23000,
+        Seeds: []string{"localhost:23000"},
+    },
+}
+
+var (
+    ErrUnknownNetwork = errors.New("unknown network")
+    ErrWrongNetwork = errors.New("data directory belongs to another network")
+    ErrBadGenesis = errors.New("invalid genesis parameters")
+)
+
+func LookupNetwork(name string) (ChainParams, error) {
+    params, ok := Networks[name]
+    if !ok {
+        return ChainParams{}, fmt.Errorf("%w: %s", ErrUnknownNetwork, name)
+    }
+    return params, nil
+}
+
+func (p ChainParams) BlockReward(sincerity int) int {
+    return int(math.Pow(2, -1*float64(sincerity))*float64(p.Reward))
+}
+
+func (p ChainParams) addValue(sum, value int) (int, bool) {
+    if value < 0 || value > p.MaxMoney || sum > p.MaxMoney-value {
+        return 0, false
+    }
+    return sum + value, true
+}
+
+func (p ChainParams) GenesisBlock() (*Block, error) {
+    pubKeyHash, err := hex.DecodeString(p.Genesis.PubKeyHash)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s genesis payee: %s", ErrBadGenesis, p.Name, err)
+    }
+    hash, err := hex.DecodeString(p.Genesis.Hash)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s genesis hash: %s", ErrBadGenesis, p.Name, err)
+    }
+
+    coinbase := &Transaction{
+        Inputs: []TxInput{{[]byte{}, -1, nil, []byte(p.Genesis.Data)}},
+        Outputs: []TxOutput{{p.BlockReward(0), pubKeyHash}},
+    }
+    coinbase.ID = coinbase.Hash()
+
+    header := BlockHeader{BlockVersion, p.Genesis.Timestamp, hash, []byte{}, nil, p.Genesis.Nonce, 0, p.Retarget.InitialDifficulty, 0}
+    block := &Block{header, []*Transaction{coinbase}}
+    block.MerkleRoot = block.HashTransactions()
+    if err := CheckBlock(block); err != nil {
+        return nil, fmt.Errorf("%w: %s: %s", ErrBadGenesis, p.Name, err)
+    }
+    return block, nil
+}
+
+func (p ChainParams) DataDir(base string) string {
+    if p.Name == DefaultNetwork {
+        return base
+    }
+    return filepath.Join(base, p.Name)
+}
+
+func loadNetwork(db storage.Store) (string, error) {
+    network := DefaultNetwork
+    err := db.View(func(txn storage.Txn) error {
+        value, err := txn.Get([]byte("net"))
+        if err == storage.ErrNotFound {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        network = string(value)
+        return nil
+    })
+    return network, err
+}
@@ -1,82 +1,154 @@
 package blockchain
 
 import (
-    "log"
+    "context"
     "fmt"
     "crypto/sha256"
     "encoding/binary"
     "bytes"
     "math/big"
     "math"
+    "sync"
+    "sync/atomic"
+    "time"
 )
 
-const Difficulty = 18
+const (
+    MaxNonce = math.MaxInt64
+    nonceCheckInterval = 1 << 12
+)
 
 type ProofOfWork struct {
-    Block *Block
+    Header *BlockHeader
     Target *big.Int
 }
 
-func NewProof(b *Block) *ProofOfWork {
+type MiningStats struct {
+    Workers int
+    Hashes uint64
+    Elapsed time.Duration
+}
+
+func (s MiningStats) HashRate() float64 {
+    if s.Elapsed <= 0 {
+        return 0
+    }
+    return float64(s.Hashes) / s.Elapsed.Seconds()
+}
+
+func (s MiningStats) String() string {
+    return fmt.Sprintf("%d hashes in %s on %d workers (%.0f H/s)",
+        s.Hashes, s.Elapsed.Round(time.Millisecond), s.Workers, s.HashRate())
+}
+
+func NewProof(h *BlockHeader) *ProofOfWork {
     target := big.NewInt(1)
-    target.Lsh(target, uint(256-Difficulty))
+    target.Lsh(target, uint(256-h.Difficulty))
 
-    pow := &ProofOfWork{b, target}
+    pow := &ProofOfWork{h, target}
 
     return pow
 }
 
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-    data := bytes.Join(
-        [][]byte{
-            pow.Block.PrevHash,
-            pow.Block.HashTransactions(),
-            ToHex(int64(nonce)),
-            ToHex(int64(Difficulty)),
-        },
-        []byte{},
-    )
-    return data
+    return pow.Header.HashData(nonce)
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-    var intHash big.Int
-    var hash [32]byte
-    nonce := 0
+func (pow *ProofOfWork) Run(ctx context.Context, workers int) (MiningStats, error) {
+    if workers < 1 {
+        workers = 1
+    }
+    stats := MiningStats{Workers: workers}
+    start := time.Now()
+
+    for {
+        nonce, hash, hashes, err := pow.search(ctx, workers)
+        stats.Hashes += hashes
+        stats.Elapsed = time.Since(start)
+        if err != nil {
+            return stats, err
+        }
+        if hash != nil {
+            pow.Header.Nonce = nonce
+            pow.Header.Hash = hash
+            return stats, nil
+        }
+        pow.Header.Timestamp++
+    }
+}
 
-    for nonce < math.MaxInt64 {
-        data := pow.InitData(nonce)
-        hash = sha256.Sum256(data)
+func (pow *ProofOfWork) search(ctx context.Context, workers int) (int, []byte, uint64, error) {
+    type solution struct {
+        nonce int
+        hash []byte
+    }
+
+    searchCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
 
-        fmt.Printf("\r%x", hash)
-        intHash.SetBytes(hash[:])
+    found := make(chan solution, workers)
+    var hashes uint64
+    var wg sync.WaitGroup
 
-        if intHash.Cmp(pow.Target) == -1 {
-            break
-        } else {
-            nonce++
+    span := MaxNonce / workers
+    for i := 0; i < workers; i++ {
+        first, last := i*span, (i+1)*span
+        if i == workers-1 {
+            last = MaxNonce
         }
+
+        wg.Add(1)
+        go func(first, last int) {
+            defer wg.Done()
+            var intHash big.Int
+            var count uint64
+            defer func() { atomic.AddUint64(&hashes, count) }()
+
+            for nonce := first; nonce < last; nonce++ {
+                if count%nonceCheckInterval == 0 && searchCtx.Err() != nil {
+                    return
+                }
+                hash := sha256.Sum256(pow.InitData(nonce))
+                count++
+
+                intHash.SetBytes(hash[:])
+                if intHash.Cmp(pow.Target) == -1 {
+                    found <- solution{nonce, hash[:]}
+                    cancel()
+                    return
+                }
+            }
+        }(first, last)
     }
-    fmt.Println()
-    return nonce, hash[:]
+    wg.Wait()
+
+    select {
+    case s := <-found:
+        return s.nonce, s.hash, hashes, nil
+    default:
+    }
+    return 0, nil, hashes, ctx.Err()
 }
 
 func (pow *ProofOfWork) Validate() bool {
     var intHash big.Int
 
-    data := pow.InitData(pow.Block.Nonce)
+    data := pow.InitData(pow.Header.Nonce)
     hash := sha256.Sum256(data)
     intHash.SetBytes(hash[:])
 
-    return intHash.Cmp(pow.Target) == -1
+    return intHash.Cmp(pow.Target) == -1 && bytes.Equal(hash[:], pow.Header.Hash)
+}
 
+func (pow *ProofOfWork) Work() *big.Int {
+    denominator := new(big.Int).Add(pow.Target, big.NewInt(1))
+    numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+
+    return numerator.Div(numerator, denominator)
 }
 
 func ToHex(num int64) []byte {
-    buff := new(bytes.Buffer)
-    err := binary.Write(buff, binary.BigEndian, num)
-    if err != nil {
-        log.Panic(err)
-    }
-    return buff.Bytes()
+    buff := make([]byte, 8)
+    binary.BigEndian.PutUint64(buff, uint64(num))
+    return buff
 }
@@ -0,0 +1,50 @@
+package blockchain
+
+import "math"
+
+type RetargetParams struct {
+    InitialDifficulty int
+    MinDifficulty int
+    MaxDifficulty int
+    Interval int
+    TargetSpacing int64
+    MaxAdjustment int
+}
+
+func (chain *BlockChain) NextDifficulty(parent *BlockHeader) (int, error) {
+    params := chain.Params.Retarget
+    height := parent.Height + 1
+    if params.Interval <= 1 || height%params.Interval != 0 {
+        return parent.Difficulty, nil
+    }
+
+    first := parent
+    for i := 0; i < params.Interval-1; i++ {
+        header, err := chain.GetHeader(first.PrevHash)
+        if err != nil {
+            return 0, err
+        }
+        first = &header
+    }
+
+    expected := params.TargetSpacing * int64(params.Interval-1)
+    actual := parent.Timestamp - first.Timestamp
+    if actual < 1 {
+        actual = 1
+    }
+
+    adjustment := int(math.Round(math.Log2(float64(expected) / float64(actual))))
+    if adjustment > params.MaxAdjustment {
+        adjustment = params.MaxAdjustment
+    } else if adjustment < -params.MaxAdjustment {
+        adjustment = -params.MaxAdjustment
+    }
+
+    difficulty := parent.Difficulty + adjustment
+    if difficulty < params.MinDifficulty {
+        difficulty = params.MinDifficulty
+    } else if difficulty > params.MaxDifficulty {
+        difficulty = params.MaxDifficulty
+    }
+    return difficulty, nil
+}
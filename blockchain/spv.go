@@ -0,0 +1,436 @@
+package blockchain
+
+import (
+    "bytes"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "path/filepath"
+
+    "github.com/viscory/reciprocus/codec"
+    "github.com/viscory/reciprocus/storage"
+)
+
+const (
+    lightPath = "headers_%s"
+    MaxHeaders = 2000
+    MaxProofKeys = 64
+)
+
+var (
+    lightKey = []byte("light")
+    proofPrefix = []byte("spv-")
+
+    ErrNotLightChain = errors.New("database does not hold a light chain")
+    ErrWrongGenesis = errors.New("genesis header does not match")
+    ErrBadTxProof = errors.New("invalid transaction proof")
+    ErrTooManyKeys = errors.New("too many keys in proof request")
+    ErrNoTxIndex = errors.New("proofs require the transaction index")
+)
+
+type TxProof struct {
+    BlockHash []byte
+    Transaction Transaction
+    Proof MerkleProof
+    Unspent []int
+}
+
+func (p *TxProof) encode(w *codec.Writer) {
+    w.PutBytes(p.BlockHash)
+    p.Transaction.encode(w)
+    w.PutUint32(uint32(p.Proof.Index))
+    w.PutUint32(uint32(len(p.Proof.Hashes)))
+    for _, hash := range p.Proof.Hashes {
+        w.PutBytes(hash)
+    }
+    w.PutUint32(uint32(len(p.Unspent)))
+    for _, index := range p.Unspent {
+        w.PutUint32(uint32(index))
+    }
+}
+
+func decodeTxProof(r *codec.Reader) TxProof {
+    var p TxProof
+    p.BlockHash = r.Bytes()
+    p.Transaction = decodeTransaction(r)
+    p.Proof.Index = int(r.Uint32())
+    for i, n := 0, r.Count(); i < n; i++ {
+        p.Proof.Hashes = append(p.Proof.Hashes, r.Bytes())
+    }
+    for i, n := 0, r.Count(); i < n; i++ {
+        p.Unspent = append(p.Unspent, int(r.Uint32()))
+    }
+    return p
+}
+
+func (p *TxProof) Serialize() []byte {
+    w := newWriter()
+    p.encode(w)
+    return w.Bytes()
+}
+
+func DeserializeTxProof(data []byte) (TxProof, error) {
+    r, err := newReader(data, "tx proof")
+    if err != nil {
+        return TxProof{}, err
+    }
+    p := decodeTxProof(r)
+    if err := finish(r, "tx proof"); err != nil {
+        return TxProof{}, err
+    }
+    return p, nil
+}
+
+func OpenLightChain(dataDir, nodeId, network string) (*BlockChain, error) {
+    params, err := LookupNetwork(network)
+    if err != nil {
+        return nil, err
+    }
+    path := filepath.Join(params.DataDir(dataDir), fmt.Sprintf(lightPath, nodeId))
+
+    db, err := storage.OpenBadger(path)
+    if err != nil {
+        return nil, err
+    }
+    chain, err := NewLightChain(db, network)
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return chain, nil
+}
+
+func NewLightChain(db storage.Store, network string) (*BlockChain, error) {
+    params, err := LookupNetwork(network)
+    if err != nil {
+        return nil, err
+    }
+    genesis, err := params.GenesisBlock()
+    if err != nil {
+        return nil, err
+    }
+
+    var lastHash []byte
+    err = db.Update(func(txn storage.Txn) error {
+        stored, err := txn.Get([]byte("net"))
+        if err == storage.ErrNotFound {
+            if err := txn.Put([]byte("net"), []byte(network)); err != nil {
+                return err
+            }
+            if err := txn.Put(formatKey, []byte{EncodingVersion}); err != nil {
+                return err
+            }
+            if err := txn.Put(lightKey, []byte{1}); err != nil {
+                return err
+            }
+        } else if err != nil {
+            return err
+        } else if string(stored) != network {
+            return fmt.Errorf("%w: holds a %s chain", ErrWrongNetwork, stored)
+        } else if _, err := txn.Get(lightKey); err == storage.ErrNotFound {
+            return ErrNotLightChain
+        } else if err != nil {
+            return err
+        }
+
+        hash, err := txn.Get(heightKey(0))
+        if err == storage.ErrNotFound {
+            if err := putHeader(txn, &genesis.BlockHeader, NewProof(&genesis.BlockHeader).Work().Bytes()); err != nil {
+                return err
+            }
+            if err := txn.Put(heightKey(0), genesis.Hash); err != nil {
+                return err
+            }
+            lastHash = genesis.Hash
+            return txn.Put([]byte("lh"), genesis.Hash)
+        } else if err != nil {
+            return err
+        }
+        if !bytes.Equal(hash, genesis.Hash) {
+            return fmt.Errorf("%w: database holds %x, %s expects %x", ErrWrongGenesis, hash, network, genesis.Hash)
+        }
+        lastHash, err = txn.Get([]byte("lh"))
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    if err := checkFormat(db); err != nil {
+        return nil, err
+    }
+
+    chain := BlockChain{LastHash: lastHash, Database: db, Params: params, Light: true}
+    return &chain, nil
+}
+
+func (chain *BlockChain) AddHeaders(headers []*BlockHeader) (int, error) {
+    added := 0
+    for _, header := range headers {
+        if _, err := chain.GetHeader(header.Hash); err == nil {
+            continue
+        }
+
+        if len(header.PrevHash) == 0 {
+            return added, fmt.Errorf("%w: %x", ErrWrongGenesis, header.Hash)
+        }
+
+        if err := chain.AddHeader(header); err != nil {
+            return added, err
+        }
+        added++
+
+        work, err := chain.GetChainWork(header.Hash)
+        if err != nil {
+            return added, err
+        }
+        tipWork, err := chain.GetChainWork(chain.LastHash)
+        if err != nil {
+            return added, err
+        }
+        if work.Cmp(tipWork) > 0 {
+            if err := chain.setHeaderTip(header); err != nil {
+                return added, err
+            }
+        }
+    }
+    return added, nil
+}
+
+func (chain *BlockChain) setHeaderTip(tip *BlockHeader) error {
+    oldTip, err := chain.GetHeader(chain.LastHash)
+    if err != nil {
+        return err
+    }
+
+    var connect []*BlockHeader
+    header := tip
+    for {
+        hash, err := chain.GetBlockHashByHeight(header.Height)
+        if err == nil && bytes.Equal(hash, header.Hash) {
+            break
+        }
+        connect = append(connect, header)
+        parent, err := chain.GetHeader(header.PrevHash)
+        if err != nil {
+            return err
+        }
+        header = &parent
+    }
+
+    err = chain.Database.Update(func(txn storage.Txn) error {
+        for height := tip.Height + 1; height <= oldTip.Height; height++ {
+            if err := txn.Delete(heightKey(height)); err != nil {
+                return err
+            }
+        }
+        for _, h := range connect {
+            if err := txn.Put(heightKey(h.Height), h.Hash); err != nil {
+                return err
+            }
+        }
+        return txn.Put([]byte("lh"), tip.Hash)
+    })
+    if err != nil {
+        return err
+    }
+    chain.LastHash = tip.Hash
+    return nil
+}
+
+func (chain *BlockChain) GetHeaders(locator [][]byte) ([]*BlockHeader, error) {
+    start := chain.locateFork(locator)
+    bestHeight, err := chain.GetBestHeight()
+    if err != nil {
+        return nil, err
+    }
+
+    var headers []*BlockHeader
+    for height := start; height <= bestHeight && len(headers) < MaxHeaders; height++ {
+        hash, err := chain.GetBlockHashByHeight(height)
+        if err != nil {
+            return nil, err
+        }
+        header, err := chain.GetHeader(hash)
+        if err != nil {
+            return nil, err
+        }
+        headers = append(headers, &header)
+    }
+    return headers, nil
+}
+
+func (chain *BlockChain) ProveTransaction(ID []byte) (TxProof, error) {
+    _, header, err := chain.LocateTransaction(ID)
+    if err != nil {
+        return TxProof{}, err
+    }
+    block, err := chain.GetBlock(header.Hash)
+    if err != nil {
+        return TxProof{}, err
+    }
+    for i, tx := range block.Transactions {
+        if !bytes.Equal(tx.ID, ID) {
+            continue
+        }
+        proof, err := block.MerkleTree().Proof(i)
+        if err != nil {
+            return TxProof{}, err
+        }
+        return TxProof{BlockHash: block.Hash, Transaction: *tx, Proof: proof}, nil
+    }
+    return TxProof{}, ErrTxNotFound
+}
+
+func (chain *BlockChain) ProveUnspent(pubKeyHashes [][]byte) ([]TxProof, error) {
+    if len(pubKeyHashes) > MaxProofKeys {
+        return nil, fmt.Errorf("%w: %d, at most %d", ErrTooManyKeys, len(pubKeyHashes), MaxProofKeys)
+    }
+    if !chain.TxIndex {
+        return nil, ErrNoTxIndex
+    }
+
+    unspent := make(map[string][]int)
+    err := chain.Database.View(func(txn storage.Txn) error {
+        return txn.Iterate(utxoPrefix, func(k, v []byte) error {
+            outs, err := DeserializeOutputs(v)
+            if err != nil {
+                return err
+            }
+            txID := hex.EncodeToString(bytes.TrimPrefix(k, utxoPrefix))
+            for i, out := range outs.Outputs {
+                for _, pubKeyHash := range pubKeyHashes {
+                    if out.IsLockedWithKey(pubKeyHash) {
+                        unspent[txID] = append(unspent[txID], outs.Indexes[i])
+                        break
+                    }
+                }
+            }
+            return nil
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var proofs []TxProof
+    for txID, indexes := range unspent {
+        ID, err := hex.DecodeString(txID)
+        if err != nil {
+            return nil, err
+        }
+        proof, err := chain.ProveTransaction(ID)
+        if err != nil {
+            return nil, err
+        }
+        proof.Unspent = indexes
+        proofs = append(proofs, proof)
+    }
+    return proofs, nil
+}
+
+func (chain *BlockChain) onMainChain(blockHash []byte) (*BlockHeader, error) {
+    header, err := chain.GetHeader(blockHash)
+    if err != nil {
+        return nil, err
+    }
+    hash, err := chain.GetBlockHashByHeight(header.Height)
+    if err != nil {
+        return nil, err
+    }
+    if !bytes.Equal(hash, blockHash) {
+        return nil, fmt.Errorf("%w: block %x is not on the best chain", ErrHeaderNotFound, blockHash)
+    }
+    return &header, nil
+}
+
+func (chain *BlockChain) VerifyTxProof(p *TxProof) error {
+    header, err := chain.onMainChain(p.BlockHash)
+    if err != nil {
+        return fmt.Errorf("%w: %s", ErrBadTxProof, err)
+    }
+    tx := &p.Transaction
+    if !VerifyMerkleProof(header.MerkleRoot, tx.Serialize(), p.Proof) {
+        return fmt.Errorf("%w: tx %x is not in block %x", ErrBadTxProof, tx.ID, p.BlockHash)
+    }
+    for _, index := range p.Unspent {
+        if index < 0 || index >= len(tx.Outputs) {
+            return fmt.Errorf("%w: tx %x has no output %d", ErrBadTxProof, tx.ID, index)
+        }
+    }
+    return nil
+}
+
+func proofKey(pubKeyHash, txID []byte) []byte {
+    key := append(append([]byte{}, proofPrefix...), pubKeyHash...)
+    return append(key, txID...)
+}
+
+func (chain *BlockChain) SaveTxProofs(pubKeyHashes [][]byte, proofs []TxProof) error {
+    return chain.Database.Update(func(txn storage.Txn) error {
+        var stale [][]byte
+        for _, pubKeyHash := range pubKeyHashes {
+            err := txn.Iterate(proofKey(pubKeyHash, nil), func(k, v []byte) error {
+                stale = append(stale, append([]byte{}, k...))
+                return nil
+            })
+            if err != nil {
+                return err
+            }
+        }
+        for _, key := range stale {
+            if err := txn.Delete(key); err != nil {
+                return err
+            }
+        }
+        for i := range proofs {
+            tx := &proofs[i].Transaction
+            for _, pubKeyHash := range pubKeyHashes {
+                for _, index := range proofs[i].Unspent {
+                    if index < 0 || index >= len(tx.Outputs) || !tx.Outputs[index].IsLockedWithKey(pubKeyHash) {
+                        continue
+                    }
+                    if err := txn.Put(proofKey(pubKeyHash, tx.ID), proofs[i].Serialize()); err != nil {
+                        return err
+                    }
+                    break
+                }
+            }
+        }
+        return nil
+    })
+}
+
+func (chain *BlockChain) ProvenOutputs(pubKeyHash []byte) ([]TxOutput, error) {
+    var proofs []TxProof
+    err := chain.Database.View(func(txn storage.Txn) error {
+        return txn.Iterate(proofKey(pubKeyHash, nil), func(k, v []byte) error {
+            proof, err := DeserializeTxProof(v)
+            if err != nil {
+                return err
+            }
+            proofs = append(proofs, proof)
+            return nil
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var outputs []TxOutput
+    for i := range proofs {
+        if _, err := chain.onMainChain(proofs[i].BlockHash); err != nil {
+            continue
+        }
+        outs := proofs[i].Transaction.Outputs
+        for _, index := range proofs[i].Unspent {
+            if index < 0 || index >= len(outs) {
+                continue
+            }
+            out := outs[index]
+            if out.IsLockedWithKey(pubKeyHash) {
+                outputs = append(outputs, out)
+            }
+        }
+    }
+    return outputs, nil
+}
@@ -1,23 +1,24 @@
 package blockchain
 
 import (
-    "bytes"
+    "errors"
     "fmt"
-    "log"
     "strings"
     "math/big"
-    "math"
     "crypto/sha256"
     "crypto/ecdsa"
     "crypto/elliptic"
     "crypto/rand"
-    "encoding/gob"
     "encoding/hex"
+    "github.com/viscory/reciprocus/codec"
     "github.com/viscory/reciprocus/wallet"
 )
 
-const (
-    BLOCK_REWARD = 4096
+const MAX_SINCERITY = 12
+
+var (
+    ErrInsufficientFunds = errors.New("not enough funds")
+    ErrMissingPrevTx = errors.New("previous transaction does not exist")
 )
 
 type Transaction struct {
@@ -26,25 +27,62 @@ type Transaction struct {
     Outputs []TxOutput
 }
 
-func (tx Transaction) Serialize() []byte {
-    var encoded bytes.Buffer
+func (tx *Transaction) encode(w *codec.Writer) {
+    w.PutBytes(tx.ID)
+    w.PutUint32(uint32(len(tx.Inputs)))
+    for _, in := range tx.Inputs {
+        in.encode(w)
+    }
+    w.PutUint32(uint32(len(tx.Outputs)))
+    for _, out := range tx.Outputs {
+        out.encode(w)
+    }
+}
 
-    enc := gob.NewEncoder(&encoded)
-    err := enc.Encode(tx)
-    if err != nil {
-        log.Panic(err)
+func decodeTransaction(r *codec.Reader) Transaction {
+    var tx Transaction
+    tx.ID = r.Bytes()
+    for i, n := 0, r.Count(); i < n; i++ {
+        tx.Inputs = append(tx.Inputs, decodeInput(r))
+    }
+    for i, n := 0, r.Count(); i < n; i++ {
+        tx.Outputs = append(tx.Outputs, decodeOutput(r))
+    }
+    return tx
+}
+
+func encodeTransactions(w *codec.Writer, txs []*Transaction) {
+    w.PutUint32(uint32(len(txs)))
+    for _, tx := range txs {
+        tx.encode(w)
     }
+}
 
-    return encoded.Bytes()
+func decodeTransactions(r *codec.Reader) []*Transaction {
+    var txs []*Transaction
+    for i, n := 0, r.Count(); i < n && r.Err() == nil; i++ {
+        tx := decodeTransaction(r)
+        txs = append(txs, &tx)
+    }
+    return txs
 }
 
-func DeserializeTransactions(data []byte) Transaction {
-    var transaction Transaction
+func (tx Transaction) Serialize() []byte {
+    w := newWriter()
+    tx.encode(w)
+    return w.Bytes()
+}
 
-    decoder := gob.NewDecoder(bytes.NewReader(data))
-    err := decoder.Decode(&transaction)
-    Handle(err)
-    return transaction
+func DeserializeTransactions(data []byte) (Transaction, error) {
+    r, err := newReader(data, "transaction")
+    if err != nil {
+        return Transaction{}, err
+    }
+    tx := decodeTransaction(r)
+    if err := finish(r, "transaction"); err != nil {
+        return Transaction{}, err
+    }
+    return tx, nil
 }
 
 func (tx *Transaction) Hash() []byte {
@@ -58,40 +96,48 @@ func (tx *Transaction) Hash() []byte {
     return hash[:]
 }
 
-func CoinbaseTx(to, data string, sincerity int) *Transaction {
+func CoinbaseTx(to, data string, value int) (*Transaction, error) {
     if data == "" {
         randData := make([]byte, 24)
         _, err := rand.Read(randData)
         if err != nil {
-            log.Panic(err)
+            return nil, err
         }
         data = fmt.Sprintf("%x", randData)
     }
 
 
     txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-    txout := NewTxOutput(int(math.Pow(2, -1*float64(sincerity))*BLOCK_REWARD), to)
+    txout, err := NewTxOutput(value, to)
+    if err != nil {
+        return nil, err
+    }
 
     tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
     tx.ID = tx.Hash()
 
-    return &tx
+    return &tx, nil
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
     var inputs []TxInput
     var outputs []TxOutput
 
     pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-    acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+    acc, validOutputs, err := UTXO.FindSpendableOutputs(pubKeyHash, amount+fee)
+    if err != nil {
+        return nil, err
+    }
 
-    if acc < amount {
-        log.Panic("Not enough funds")
+    if acc < amount+fee {
+        return nil, fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, acc, amount+fee)
     }
 
     for txid, outs := range validOutputs {
         txID, err := hex.DecodeString(txid)
-        Handle(err)
+        if err != nil {
+            return nil, err
+        }
 
         for _, out := range outs {
             input := TxInput{txID, out, nil, w.PublicKey}
@@ -101,31 +147,44 @@ func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Tra
 
     from := fmt.Sprintf("%s", w.Address())
 
-    outputs = append(outputs, *NewTxOutput(amount, to))
+    output, err := NewTxOutput(amount, to)
+    if err != nil {
+        return nil, err
+    }
+    outputs = append(outputs, *output)
 
-    if acc > amount {
-        outputs = append(outputs, *NewTxOutput(acc-amount, from))
+    if acc > amount+fee {
+        change, err := NewTxOutput(acc-amount-fee, from)
+        if err != nil {
+            return nil, err
+        }
+        outputs = append(outputs, *change)
     }
 
     tx := Transaction{nil, inputs, outputs}
-    tx.ID = tx.Hash()
-    UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
+    if err := UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey); err != nil {
+        return nil, err
+    }
 
-    return &tx
+    return &tx, nil
 }
 
 func (tx *Transaction) IsCoinBase() bool {
     return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
     if tx.IsCoinBase() {
-        return
+        return nil
     }
 
     for _, in := range tx.Inputs {
-        if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-            log.Panic("Previous Transaction Does Not Exist")
+        prevTX := prevTXs[hex.EncodeToString(in.ID)]
+        if prevTX.ID == nil {
+            return fmt.Errorf("%w: %x", ErrMissingPrevTx, in.ID)
+        }
+        if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+            return fmt.Errorf("%w: %x has no output %d", ErrMissingPrevTx, in.ID, in.Out)
         }
     }
 
@@ -139,11 +198,16 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
         txCopy.Inputs[inId].PubKey = nil
 
         r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-        Handle(err)
-        signature := append(r.Bytes(), s.Bytes()...)
+        if err != nil {
+            return err
+        }
+        size := (privKey.Curve.Params().BitSize + 7) / 8
+        signature := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
 
         tx.Inputs[inId].Signature = signature
     }
+    tx.ID = tx.Hash()
+    return nil
 }
 
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
@@ -153,7 +217,7 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
     
     for _, in := range tx.Inputs {
         if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-            log.Panic("Previous transaction doesn't exist")
+            return false
         }
     }
 
@@ -162,6 +226,9 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 
     for inId, in := range tx.Inputs {
         prevTx := prevTXs[hex.EncodeToString(in.ID)]
+        if in.Out < 0 || in.Out >= len(prevTx.Outputs) || !in.UsesKey(prevTx.Outputs[in.Out].PubKeyHash) {
+            return false
+        }
         txCopy.Inputs[inId].Signature = nil
         txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
         txCopy.ID = txCopy.Hash()
@@ -179,7 +246,7 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
         x.SetBytes(in.PubKey[:(keyLen/2)])
         y.SetBytes(in.PubKey[(keyLen/2):])
 
-        rawPubKey := ecdsa.PublicKey{curve, &x, &y}
+        rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
         if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
             return false
         }
@@ -2,8 +2,8 @@ package blockchain
 
 import (
     "bytes"
+    "github.com/viscory/reciprocus/codec"
     "github.com/viscory/reciprocus/wallet"
-    "encoding/gob"
 )
 
 type TxOutput struct {
@@ -13,6 +13,7 @@ type TxOutput struct {
 
 type TxOutputs struct {
     Outputs []TxOutput
+    Indexes []int
 }
 
 type TxInput struct {
@@ -22,11 +23,13 @@ type TxInput struct {
     PubKey []byte 
 }
 
-func NewTxOutput(value int, address string) *TxOutput {
+func NewTxOutput(value int, address string) (*TxOutput, error) {
     txo := &TxOutput{value, nil}
-    txo.Lock([]byte(address))
+    if err := txo.Lock([]byte(address)); err != nil {
+        return nil, err
+    }
 
-    return txo
+    return txo, nil
 }
 
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
@@ -34,28 +37,78 @@ func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
     return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
-func (out *TxOutput) Lock(address []byte) {
-    pubKeyHash := wallet.Base58Decode(address)
-    pubKeyHash = pubKeyHash[1:len(pubKeyHash)-4]
+func (out *TxOutput) Lock(address []byte) error {
+    pubKeyHash, err := wallet.AddressToPubKeyHash(string(address))
+    if err != nil {
+        return err
+    }
     out.PubKeyHash = pubKeyHash
+    return nil
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
     return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
 }
 
+func (in *TxInput) encode(w *codec.Writer) {
+    w.PutBytes(in.ID)
+    w.PutInt32(int32(in.Out))
+    w.PutBytes(in.Signature)
+    w.PutBytes(in.PubKey)
+}
+
+func decodeInput(r *codec.Reader) TxInput {
+    var in TxInput
+    in.ID = r.Bytes()
+    in.Out = int(r.Int32())
+    in.Signature = r.Bytes()
+    in.PubKey = r.Bytes()
+    return in
+}
+
+func (out *TxOutput) encode(w *codec.Writer) {
+    w.PutInt64(int64(out.Value))
+    w.PutBytes(out.PubKeyHash)
+}
+
+func decodeOutput(r *codec.Reader) TxOutput {
+    var out TxOutput
+    out.Value = int(r.Int64())
+    out.PubKeyHash = r.Bytes()
+    return out
+}
+
 func (outs TxOutputs) Serialize() []byte {
-    var buffer bytes.Buffer
-    encode := gob.NewEncoder(&buffer)
-    err := encode.Encode(outs)
-    Handle(err)
-    return buffer.Bytes()
+    w := newWriter()
+    w.PutUint32(uint32(len(outs.Outputs)))
+    for i, out := range outs.Outputs {
+        w.PutUint32(uint32(outs.Indexes[i]))
+        out.encode(w)
+    }
+    return w.Bytes()
+}
+
+func (outs TxOutputs) Find(index int) (TxOutput, bool) {
+    for i, outIdx := range outs.Indexes {
+        if outIdx == index {
+            return outs.Outputs[i], true
+        }
+    }
+    return TxOutput{}, false
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
+func DeserializeOutputs(data []byte) (TxOutputs, error) {
     var outputs TxOutputs
-    decode := gob.NewDecoder(bytes.NewReader(data))
-    err := decode.Decode(&outputs)
-    Handle(err)
-    return outputs
+    r, err := newReader(data, "outputs")
+    if err != nil {
+        return outputs, err
+    }
+    for i, n := 0, r.Count(); i < n; i++ {
+        outputs.Indexes = append(outputs.Indexes, int(r.Uint32()))
+        outputs.Outputs = append(outputs.Outputs, decodeOutput(r))
+    }
+    if err := finish(r, "outputs"); err != nil {
+        return TxOutputs{}, err
+    }
+    return outputs, nil
 }
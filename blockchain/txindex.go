@@ -0,0 +1,162 @@
+package blockchain
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+
+    "github.com/viscory/reciprocus/storage"
+)
+
+var (
+    txPrefix = []byte("tx-")
+    txIndexKey = []byte("txindex")
+
+    ErrTxNotFound = errors.New("transaction does not exist")
+)
+
+type TxLocation struct {
+    BlockHash []byte
+    Position int
+}
+
+func (loc TxLocation) Serialize() []byte {
+    w := newWriter()
+    w.PutBytes(loc.BlockHash)
+    w.PutUint32(uint32(loc.Position))
+    return w.Bytes()
+}
+
+func DeserializeLocation(data []byte) (TxLocation, error) {
+    var loc TxLocation
+    r, err := newReader(data, "tx location")
+    if err != nil {
+        return loc, err
+    }
+    loc.BlockHash = r.Bytes()
+    loc.Position = int(r.Uint32())
+    if err := finish(r, "tx location"); err != nil {
+        return TxLocation{}, err
+    }
+    return loc, nil
+}
+
+func loadTxIndex(db storage.Store) (bool, error) {
+    enabled := false
+    err := db.View(func(txn storage.Txn) error {
+        _, err := txn.Get(txIndexKey)
+        if err == storage.ErrNotFound {
+            return nil
+        }
+        enabled = err == nil
+        return err
+    })
+    return enabled, err
+}
+
+func indexTransactions(txn storage.Txn, block *Block) error {
+    for i, tx := range block.Transactions {
+        loc := TxLocation{block.Hash, i}
+        if err := txn.Put(append(txPrefix, tx.ID...), loc.Serialize()); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func unindexTransactions(txn storage.Txn, block *Block) error {
+    for _, tx := range block.Transactions {
+        if err := txn.Delete(append(txPrefix, tx.ID...)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (chain *BlockChain) LocateTransaction(ID []byte) (Transaction, *BlockHeader, error) {
+    if !chain.TxIndex {
+        return chain.scanTransaction(ID)
+    }
+
+    var tx Transaction
+    var header *BlockHeader
+    err := chain.Database.View(func(txn storage.Txn) error {
+        v, err := txn.Get(append(txPrefix, ID...))
+        if err == storage.ErrNotFound {
+            return ErrTxNotFound
+        } else if err != nil {
+            return err
+        }
+        loc, err := DeserializeLocation(v)
+        if err != nil {
+            return err
+        }
+        block, err := getBlock(txn, loc.BlockHash)
+        if err != nil {
+            return err
+        }
+        if loc.Position < 0 || loc.Position >= len(block.Transactions) {
+            return fmt.Errorf("%w: tx location %x:%d", ErrCorruptData, loc.BlockHash, loc.Position)
+        }
+        tx = *block.Transactions[loc.Position]
+        header = &block.BlockHeader
+        return nil
+    })
+    return tx, header, err
+}
+
+func (chain *BlockChain) scanTransaction(ID []byte) (Transaction, *BlockHeader, error) {
+    iter := chain.Iterator()
+    for {
+        block, err := iter.Next()
+        if err != nil {
+            return Transaction{}, nil, err
+        }
+        for _, tx := range block.Transactions {
+            if bytes.Equal(tx.ID, ID) {
+                return *tx, &block.BlockHeader, nil
+            }
+        }
+
+        if len(block.PrevHash) == 0 {
+            break
+        }
+    }
+    return Transaction{}, nil, ErrTxNotFound
+}
+
+func (chain *BlockChain) ReindexTransactions() (int, error) {
+    UTXOSet := UTXOSet{Blockchain: chain}
+    if err := UTXOSet.DeleteByPrefix(txPrefix); err != nil {
+        return 0, err
+    }
+
+    count := 0
+    iter := chain.Iterator()
+    for {
+        block, err := iter.Next()
+        if err != nil {
+            return count, err
+        }
+        err = chain.Database.Update(func(txn storage.Txn) error {
+            return indexTransactions(txn, block)
+        })
+        if err != nil {
+            return count, err
+        }
+        count += len(block.Transactions)
+
+        if len(block.PrevHash) == 0 {
+            break
+        }
+    }
+
+    err := chain.Database.Update(func(txn storage.Txn) error {
+        return txn.Put(txIndexKey, []byte{1})
+    })
+    if err != nil {
+        return count, err
+    }
+    chain.TxIndex = true
+    return count, nil
+}
@@ -0,0 +1,41 @@
+package blockchain
+
+type SpentOutput struct {
+    ID []byte
+    Out int
+    Output TxOutput
+}
+
+type BlockUndo struct {
+    Spent []SpentOutput
+}
+
+func (undo BlockUndo) Serialize() []byte {
+    w := newWriter()
+    w.PutUint32(uint32(len(undo.Spent)))
+    for _, spent := range undo.Spent {
+        w.PutBytes(spent.ID)
+        w.PutInt32(int32(spent.Out))
+        spent.Output.encode(w)
+    }
+    return w.Bytes()
+}
+
+func DeserializeUndo(data []byte) (BlockUndo, error) {
+    var undo BlockUndo
+    r, err := newReader(data, "undo")
+    if err != nil {
+        return undo, err
+    }
+    for i, n := 0, r.Count(); i < n; i++ {
+        var spent SpentOutput
+        spent.ID = r.Bytes()
+        spent.Out = int(r.Int32())
+        spent.Output = decodeOutput(r)
+        undo.Spent = append(undo.Spent, spent)
+    }
+    if err := finish(r, "undo"); err != nil {
+        return BlockUndo{}, err
+    }
+    return undo, nil
+}
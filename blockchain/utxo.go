@@ -3,209 +3,316 @@ package blockchain
 import (
 	"bytes"
 	"encoding/hex"
-	"log"
-	"github.com/dgraph-io/badger"
+	"errors"
+	"fmt"
+	"github.com/viscory/reciprocus/storage"
 )
 
 var (
 	utxoPrefix   = []byte("utxo-")
+	undoPrefix   = []byte("undo-")
 	prefixLength = len(utxoPrefix)
+
+	ErrNoUndoData = errors.New("no undo data for block")
 )
 
 type UTXOSet struct {
 	Blockchain *BlockChain
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
 	db := u.Blockchain.Database
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			v, err := item.Value()
-			Handle(err)
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
+	err := db.View(func(txn storage.Txn) error {
+		return txn.Iterate(utxoPrefix, func(k, v []byte) error {
+			txID := hex.EncodeToString(bytes.TrimPrefix(k, utxoPrefix))
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
 
-			for outIdx, out := range outs.Outputs {
+			for i, out := range outs.Outputs {
 				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
 					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+					unspentOuts[txID] = append(unspentOuts[txID], outs.Indexes[i])
 				}
 			}
-		}
-		return nil
+			return nil
+		})
 	})
-	Handle(err)
-	return accumulated, unspentOuts
+	return accumulated, unspentOuts, err
 }
 
-func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TxOutput {
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) ([]TxOutput, error) {
 	var UTXOs []TxOutput
 
 	db := u.Blockchain.Database
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			v, err := item.Value()
-			Handle(err)
-			outs := DeserializeOutputs(v)
+	err := db.View(func(txn storage.Txn) error {
+		return txn.Iterate(utxoPrefix, func(k, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
 
 			for _, out := range outs.Outputs {
 				if out.IsLockedWithKey(pubKeyHash) {
 					UTXOs = append(UTXOs, out)
 				}
 			}
-		}
-
-		return nil
+			return nil
+		})
 	})
-	Handle(err)
 
-	return UTXOs
+	return UTXOs, err
 }
 
-func (u UTXOSet) CountTransactions() int {
+func (u UTXOSet) CountTransactions() (int, error) {
 	db := u.Blockchain.Database
 	counter := 0
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+	err := db.View(func(txn storage.Txn) error {
+		return txn.Iterate(utxoPrefix, func(k, v []byte) error {
 			counter++
-		}
-		return nil
+			return nil
+		})
 	})
-	Handle(err)
-	return counter
+	return counter, err
 }
 
-func (u UTXOSet) Reindex() {
+func (u UTXOSet) Reindex() error {
 	db := u.Blockchain.Database
-	u.DeleteByPrefix(utxoPrefix)
-	UTXO := u.Blockchain.FindUTXO()
-	err := db.Update(func(txn *badger.Txn) error {
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
+	UTXO, err := u.Blockchain.FindUTXO()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn storage.Txn) error {
 		for txId, outs := range UTXO {
 			key, err := hex.DecodeString(txId)
-			Handle(err)
+			if err != nil {
+				return err
+			}
 			key = append(utxoPrefix, key...)
-			err = txn.Set(key, outs.Serialize())
-			Handle(err)
+			if err := txn.Put(key, outs.Serialize()); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-	Handle(err)
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Database
+func (u UTXOSet) FindOutput(txID []byte, index int) (TxOutput, bool, error) {
+	var out TxOutput
+	found := false
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinBase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					Handle(err)
-					v, err := item.Value()
-					Handle(err)
-
-					outs := DeserializeOutputs(v)
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+	err := u.Blockchain.Database.View(func(txn storage.Txn) error {
+		var err error
+		out, found, err = findOutput(txn, txID, index)
+		return err
+	})
+	return out, found, err
+}
+
+func findOutput(txn storage.Txn, txID []byte, index int) (TxOutput, bool, error) {
+	v, err := txn.Get(append(utxoPrefix, txID...))
+	if err == storage.ErrNotFound {
+		return TxOutput{}, false, nil
+	} else if err != nil {
+		return TxOutput{}, false, err
+	}
+	outs, err := DeserializeOutputs(v)
+	if err != nil {
+		return TxOutput{}, false, err
+	}
+	out, found := outs.Find(index)
+	return out, found, nil
+}
+
+func hasOutputs(txn storage.Txn, txID []byte) (bool, error) {
+	_, err := txn.Get(append(utxoPrefix, txID...))
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (u *UTXOSet) Update(block *Block) error {
+	return u.Blockchain.Database.Update(func(txn storage.Txn) error {
+		return u.update(txn, block)
+	})
+}
 
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
+func (u *UTXOSet) update(txn storage.Txn, block *Block) error {
+	undo := BlockUndo{}
 
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
+	for _, tx := range block.Transactions {
+		if tx.IsCoinBase() == false {
+			for _, in := range tx.Inputs {
+				updatedOuts := TxOutputs{}
+				inID := append(utxoPrefix, in.ID...)
+				v, err := txn.Get(inID)
+				if err == storage.ErrNotFound {
+					return fmt.Errorf("%w: %x:%d", ErrDoubleSpend, in.ID, in.Out)
+				} else if err != nil {
+					return err
+				}
+
+				outs, err := DeserializeOutputs(v)
+				if err != nil {
+					return err
+				}
+				spent, ok := outs.Find(in.Out)
+				if !ok {
+					return fmt.Errorf("%w: %x:%d", ErrDoubleSpend, in.ID, in.Out)
+				}
+				undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, spent})
+
+				for i, out := range outs.Outputs {
+					if outs.Indexes[i] != in.Out {
+						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+						updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Indexes[i])
 					}
 				}
-			}
 
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+				if len(updatedOuts.Outputs) == 0 {
+					if err := txn.Delete(inID); err != nil {
+						return err
+					}
+				} else {
+					if err := txn.Put(inID, updatedOuts.Serialize()); err != nil {
+						return err
+					}
+				}
 			}
+		}
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
-			}
+		newOutputs := TxOutputs{}
+		for outIdx, out := range tx.Outputs {
+			newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
 		}
 
-		return nil
+		txID := append(utxoPrefix, tx.ID...)
+		if err := txn.Put(txID, newOutputs.Serialize()); err != nil {
+			return err
+		}
+	}
+	return txn.Put(append(undoPrefix, block.Hash...), undo.Serialize())
+}
+
+func (u *UTXOSet) Disconnect(block *Block) error {
+	return u.Blockchain.Database.Update(func(txn storage.Txn) error {
+		return u.disconnect(txn, block)
 	})
-	Handle(err)
 }
 
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
-	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
-			for _, key := range keysForDelete {
-				if err := txn.Delete(key); err != nil {
-					return err
-				}
+func (u *UTXOSet) disconnect(txn storage.Txn, block *Block) error {
+	undoKey := append(undoPrefix, block.Hash...)
+	v, err := txn.Get(undoKey)
+	if err == storage.ErrNotFound {
+		return fmt.Errorf("%w: %x", ErrNoUndoData, block.Hash)
+	} else if err != nil {
+		return err
+	}
+	undo, err := DeserializeUndo(v)
+	if err != nil {
+		return err
+	}
+
+	spentIdx := len(undo.Spent)
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		if err := txn.Delete(append(utxoPrefix, tx.ID...)); err != nil {
+			return err
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+
+		for j := len(tx.Inputs) - 1; j >= 0; j-- {
+			spentIdx--
+			if spentIdx < 0 {
+				return fmt.Errorf("%w: %x is incomplete", ErrNoUndoData, block.Hash)
 			}
-			return nil
-		}); err != nil {
+			spent := undo.Spent[spentIdx]
+			if err := restoreOutput(txn, spent.ID, spent.Out, spent.Output); err != nil {
+				return err
+			}
+		}
+	}
+	return txn.Delete(undoKey)
+}
+
+func restoreOutput(txn storage.Txn, txID []byte, index int, out TxOutput) error {
+	key := append(utxoPrefix, txID...)
+	outs := TxOutputs{}
+
+	v, err := txn.Get(key)
+	if err == nil {
+		outs, err = DeserializeOutputs(v)
+		if err != nil {
 			return err
 		}
-		return nil
+	} else if err != storage.ErrNotFound {
+		return err
+	}
+
+	restored := TxOutputs{}
+	inserted := false
+	for i, outIdx := range outs.Indexes {
+		if outIdx == index {
+			return nil
+		}
+		if outIdx > index && !inserted {
+			restored.Outputs = append(restored.Outputs, out)
+			restored.Indexes = append(restored.Indexes, index)
+			inserted = true
+		}
+		restored.Outputs = append(restored.Outputs, outs.Outputs[i])
+		restored.Indexes = append(restored.Indexes, outIdx)
+	}
+	if !inserted {
+		restored.Outputs = append(restored.Outputs, out)
+		restored.Indexes = append(restored.Indexes, index)
+	}
+	return txn.Put(key, restored.Serialize())
+}
+
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
+	var keysForDelete [][]byte
+	err := u.Blockchain.Database.View(func(txn storage.Txn) error {
+		return txn.Iterate(prefix, func(k, v []byte) error {
+			keysForDelete = append(keysForDelete, k)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
 	}
 
 	collectSize := 100000
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
-				keysForDelete = make([][]byte, 0, collectSize)
-				keysCollected = 0
-			}
+	for len(keysForDelete) > 0 {
+		batch := keysForDelete
+		if len(batch) > collectSize {
+			batch = batch[:collectSize]
 		}
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
+		err := u.Blockchain.Database.Update(func(txn storage.Txn) error {
+			for _, key := range batch {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+		keysForDelete = keysForDelete[len(batch):]
+	}
+	return nil
 }
@@ -0,0 +1,293 @@
+package blockchain
+
+import (
+    "bytes"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/viscory/reciprocus/storage"
+)
+
+const MaxFutureBlockTime = 2 * 60 * 60
+
+var (
+    ErrBadVersion = errors.New("unsupported block version")
+    ErrNoTransactions = errors.New("block has no transactions")
+    ErrBadPoW = errors.New("block does not satisfy proof of work")
+    ErrBadDifficulty = errors.New("block difficulty does not match the expected value")
+    ErrBadTimestamp = errors.New("block timestamp is out of range")
+    ErrBadMerkle = errors.New("merkle root does not match transactions")
+    ErrUnknownParent = errors.New("previous block not found")
+    ErrBadHeight = errors.New("block height does not follow its parent")
+    ErrBadCoinbase = errors.New("invalid coinbase transaction")
+    ErrBadSincerity = errors.New("block sincerity level is out of range")
+    ErrDoubleSpend = errors.New("input is spent or does not exist")
+    ErrBadSignature = errors.New("invalid transaction signature")
+    ErrBadValue = errors.New("transaction value is out of range")
+    ErrEmptyTransaction = errors.New("transaction has no inputs or outputs")
+    ErrDuplicateInput = errors.New("transaction spends the same output twice")
+    ErrBadOutputValue = errors.New("transaction output value must be positive")
+    ErrBadTxID = errors.New("transaction id does not match its contents")
+    ErrDuplicateTx = errors.New("block contains the same transaction twice")
+    ErrTxExists = errors.New("transaction would overwrite unspent outputs")
+    ErrInvalidBranch = errors.New("block belongs to an invalid branch")
+)
+
+func CheckHeader(header *BlockHeader) error {
+    if header.Version != BlockVersion {
+        return fmt.Errorf("%w: %d", ErrBadVersion, header.Version)
+    }
+    if header.Difficulty < 1 || header.Difficulty > 255 {
+        return fmt.Errorf("%w: %d", ErrBadDifficulty, header.Difficulty)
+    }
+    if header.Sincerity < 0 || header.Sincerity > MAX_SINCERITY {
+        return fmt.Errorf("%w: %d", ErrBadSincerity, header.Sincerity)
+    }
+    if header.Timestamp > time.Now().Unix()+MaxFutureBlockTime {
+        return fmt.Errorf("%w: %d is too far in the future", ErrBadTimestamp, header.Timestamp)
+    }
+    pow := NewProof(header)
+    if !pow.Validate() {
+        return fmt.Errorf("%w: block %x", ErrBadPoW, header.Hash)
+    }
+    return nil
+}
+
+func CheckBlock(block *Block) error {
+    if len(block.Transactions) == 0 {
+        return ErrNoTransactions
+    }
+    if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+        return fmt.Errorf("%w: block %x", ErrBadMerkle, block.Hash)
+    }
+
+    seen := make(map[string]bool)
+    for _, tx := range block.Transactions {
+        if err := checkTxID(tx); err != nil {
+            return err
+        }
+        key := hex.EncodeToString(tx.ID)
+        if seen[key] {
+            return fmt.Errorf("%w: tx %x in block %x", ErrDuplicateTx, tx.ID, block.Hash)
+        }
+        seen[key] = true
+    }
+    return CheckHeader(&block.BlockHeader)
+}
+
+func (chain *BlockChain) checkHeaderContext(header *BlockHeader) error {
+    parent, err := chain.GetHeader(header.PrevHash)
+    if err != nil {
+        return fmt.Errorf("%w: %x", ErrUnknownParent, header.PrevHash)
+    }
+    if header.Height != parent.Height+1 {
+        return fmt.Errorf("%w: got %d, parent is at %d", ErrBadHeight, header.Height, parent.Height)
+    }
+    if header.Timestamp < parent.Timestamp {
+        return fmt.Errorf("%w: %d is before its parent", ErrBadTimestamp, header.Timestamp)
+    }
+    difficulty, err := chain.NextDifficulty(&parent)
+    if err != nil {
+        return err
+    }
+    if header.Difficulty != difficulty {
+        return fmt.Errorf("%w: got %d, expected %d", ErrBadDifficulty, header.Difficulty, difficulty)
+    }
+    return nil
+}
+
+func (chain *BlockChain) checkBlockContext(block *Block) error {
+    if chain.isInvalid(block.Hash) || chain.isInvalid(block.PrevHash) {
+        return fmt.Errorf("%w: %x", ErrInvalidBranch, block.Hash)
+    }
+    if !chain.HasBlock(block.PrevHash) {
+        return fmt.Errorf("%w: %x", ErrUnknownParent, block.PrevHash)
+    }
+    return chain.checkHeaderContext(&block.BlockHeader)
+}
+
+func checkTxID(tx *Transaction) error {
+    if !bytes.Equal(tx.ID, tx.Hash()) {
+        return fmt.Errorf("%w: tx %x", ErrBadTxID, tx.ID)
+    }
+    return nil
+}
+
+func (p ChainParams) CheckTransaction(tx *Transaction) error {
+    if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+        return fmt.Errorf("%w: tx %x", ErrEmptyTransaction, tx.ID)
+    }
+    if err := checkTxID(tx); err != nil {
+        return err
+    }
+
+    seen := make(map[string]bool)
+    for _, in := range tx.Inputs {
+        outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+        if seen[outpoint] {
+            return fmt.Errorf("%w: %s in tx %x", ErrDuplicateInput, outpoint, tx.ID)
+        }
+        seen[outpoint] = true
+    }
+
+    outSum := 0
+    for _, out := range tx.Outputs {
+        if out.Value <= 0 {
+            return fmt.Errorf("%w: %d in tx %x", ErrBadOutputValue, out.Value, tx.ID)
+        }
+        var ok bool
+        if outSum, ok = p.addValue(outSum, out.Value); !ok {
+            return fmt.Errorf("%w: outputs of tx %x exceed the money supply", ErrBadValue, tx.ID)
+        }
+    }
+    return nil
+}
+
+func (p ChainParams) CheckTransactionInputs(tx *Transaction, lookup func(in TxInput) (TxOutput, Transaction, error)) (int, error) {
+    prevTXs := make(map[string]Transaction)
+    inSum := 0
+    for _, in := range tx.Inputs {
+        out, prevTx, err := lookup(in)
+        if err != nil {
+            return 0, err
+        }
+        key := hex.EncodeToString(in.ID)
+        if merged, ok := prevTXs[key]; ok {
+            prevTx = merged
+        } else {
+            prevTx.Outputs = append([]TxOutput{}, prevTx.Outputs...)
+        }
+        for len(prevTx.Outputs) <= in.Out {
+            prevTx.Outputs = append(prevTx.Outputs, TxOutput{})
+        }
+        prevTx.Outputs[in.Out] = out
+        prevTXs[key] = prevTx
+        var ok bool
+        if inSum, ok = p.addValue(inSum, out.Value); !ok {
+            return 0, fmt.Errorf("%w: inputs of tx %x exceed the money supply", ErrBadValue, tx.ID)
+        }
+    }
+
+    if !tx.Verify(prevTXs) {
+        return 0, fmt.Errorf("%w: tx %x", ErrBadSignature, tx.ID)
+    }
+
+    outSum := 0
+    for _, out := range tx.Outputs {
+        var ok bool
+        if outSum, ok = p.addValue(outSum, out.Value); !ok {
+            return 0, fmt.Errorf("%w: outputs of tx %x exceed the money supply", ErrBadValue, tx.ID)
+        }
+    }
+    if outSum > inSum {
+        return 0, fmt.Errorf("%w: tx %x spends %d of %d", ErrBadValue, tx.ID, outSum, inSum)
+    }
+    return inSum - outSum, nil
+}
+
+func (chain *BlockChain) LookupUnspent(in TxInput) (TxOutput, Transaction, error) {
+    UTXOSet := UTXOSet{Blockchain: chain}
+    out, ok, err := UTXOSet.FindOutput(in.ID, in.Out)
+    if err != nil {
+        return TxOutput{}, Transaction{}, err
+    }
+    if !ok {
+        return TxOutput{}, Transaction{}, fmt.Errorf("%w: %x:%d", ErrDoubleSpend, in.ID, in.Out)
+    }
+    prevTx, err := chain.FindTransaction(in.ID)
+    if err != nil {
+        return TxOutput{}, Transaction{}, fmt.Errorf("%w: %x:%d", ErrDoubleSpend, in.ID, in.Out)
+    }
+    return out, prevTx, nil
+}
+
+func lookupOutput(txn storage.Txn, in TxInput) (TxOutput, Transaction, error) {
+    out, ok, err := findOutput(txn, in.ID, in.Out)
+    if err != nil {
+        return TxOutput{}, Transaction{}, err
+    }
+    if !ok {
+        return TxOutput{}, Transaction{}, fmt.Errorf("%w: %x:%d", ErrDoubleSpend, in.ID, in.Out)
+    }
+    outputs := make([]TxOutput, in.Out+1)
+    outputs[in.Out] = out
+    return out, Transaction{ID: in.ID, Outputs: outputs}, nil
+}
+
+func (chain *BlockChain) checkBlockTransactions(txn storage.Txn, block *Block) error {
+    spent := make(map[string]bool)
+    created := make(map[string]*Transaction)
+    reward := 0
+    fees := 0
+
+    lookup := func(in TxInput) (TxOutput, Transaction, error) {
+        outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+        if spent[outpoint] {
+            return TxOutput{}, Transaction{}, fmt.Errorf("%w: %s spent twice in block", ErrDoubleSpend, outpoint)
+        }
+        spent[outpoint] = true
+
+        if prevTx, ok := created[hex.EncodeToString(in.ID)]; ok {
+            if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+                return TxOutput{}, Transaction{}, fmt.Errorf("%w: %s", ErrDoubleSpend, outpoint)
+            }
+            return prevTx.Outputs[in.Out], *prevTx, nil
+        }
+        return lookupOutput(txn, in)
+    }
+
+    for i, tx := range block.Transactions {
+        key := hex.EncodeToString(tx.ID)
+        if _, ok := created[key]; ok {
+            return fmt.Errorf("%w: tx %x in block %x", ErrDuplicateTx, tx.ID, block.Hash)
+        }
+        exists, err := hasOutputs(txn, tx.ID)
+        if err != nil {
+            return err
+        }
+        if exists {
+            return fmt.Errorf("%w: tx %x", ErrTxExists, tx.ID)
+        }
+
+        if tx.IsCoinBase() {
+            if i != 0 {
+                return fmt.Errorf("%w: block %x has a coinbase at position %d", ErrBadCoinbase, block.Hash, i)
+            }
+            for _, out := range tx.Outputs {
+                if out.Value <= 0 {
+                    return fmt.Errorf("%w: output of %d in tx %x", ErrBadCoinbase, out.Value, tx.ID)
+                }
+                var ok bool
+                if reward, ok = chain.Params.addValue(reward, out.Value); !ok {
+                    return fmt.Errorf("%w: outputs of tx %x exceed the money supply", ErrBadCoinbase, tx.ID)
+                }
+            }
+            created[key] = tx
+            continue
+        }
+
+        if err := chain.Params.CheckTransaction(tx); err != nil {
+            return err
+        }
+        fee, err := chain.Params.CheckTransactionInputs(tx, lookup)
+        if err != nil {
+            return err
+        }
+        var ok bool
+        if fees, ok = chain.Params.addValue(fees, fee); !ok {
+            return fmt.Errorf("%w: fees of block %x exceed the money supply", ErrBadValue, block.Hash)
+        }
+        created[key] = tx
+    }
+
+    if !block.Transactions[0].IsCoinBase() {
+        return fmt.Errorf("%w: block %x has no coinbase", ErrBadCoinbase, block.Hash)
+    }
+    allowed, ok := chain.Params.addValue(fees, chain.Params.BlockReward(block.Sincerity))
+    if !ok || reward > allowed {
+        return fmt.Errorf("%w: pays %d, sincerity %d allows %d", ErrBadCoinbase, reward, block.Sincerity, allowed)
+    }
+    return nil
+}
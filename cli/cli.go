@@ -3,264 +3,652 @@ package cli
 import (
     "github.com/viscory/reciprocus/blockchain"
     "github.com/viscory/reciprocus/wallet"
+    "github.com/viscory/reciprocus/mempool"
     "github.com/viscory/reciprocus/network"
     
+    "context"
+    "encoding/hex"
     "fmt"
     "flag"
+    "errors"
     "os"
     "runtime"
-    "log"
     "strconv"
+    "strings"
 )
 
+const (
+    ExitOK = 0
+    ExitFailure = 1
+    ExitUsage = 2
+    ExitNoChain = 3
+    ExitBadInput = 4
+)
+
+var errUsage = errors.New("invalid usage")
+
+const defaultDataDir = "./tmp"
+
 type CommandLine struct {
-    blockchain *blockchain.BlockChain
+    dataDir string
+    params blockchain.ChainParams
+}
+
+type nodeOptions struct {
+    listen string
+    externalAddr string
+    connect []string
+    seeds []string
 }
 
 func (cli *CommandLine) printUsage() {
     fmt.Println("Usage:")
     fmt.Println(" printchain - Prints the blocks in the chain")
-    fmt.Println(" getbalance -adress ADDRESS - get the balance for address")
-    fmt.Println(" send -from FROM -to TO -amount AMOUNT - send AMOUNT to TO from FROM")
-    fmt.Println(" createblockchain -address ADDRESS create(mine) a blockchain")
+    fmt.Println(" getblock -height HEIGHT | -hash HASH - prints a single block of the main chain")
+    fmt.Println(" getbalance -adress ADDRESS [-light] - get the balance for address")
+    fmt.Println(" send -from FROM -to TO -amount AMOUNT [-fee FEE] [-node HOST:PORT] - send AMOUNT to TO from FROM")
+    fmt.Println(" createblockchain [-txindex] create a blockchain from the genesis block of the network")
+    fmt.Println(" generate -address ADDRESS [-blocks N] - mine N blocks paying their reward to ADDRESS")
     fmt.Println(" createwallet - create new wallet")
     fmt.Println(" getalwallets - lists all wallets inside wallet file")
     fmt.Println(" reindexutxo - reindexes utxo set")
-    fmt.Println(" startnode -miner ADDRESS -sincerity SINCERITY - start a node with id specified as $NODE_ID")
+    fmt.Println(" reindextx - rebuilds and enables the transaction index")
+    fmt.Println(" migratedb - re-imports a database written by an older release, re-signing its spends with the wallet file")
+    fmt.Println(" gettransaction -id TXID - prints a transaction and its confirmations")
+    fmt.Println(" startnode -miner ADDRESS -sincerity SINCERITY [-maxblocksize BYTES] [-workers N] - start a node with id specified as $NODE_ID (defaults to the network port)")
+    fmt.Println(" startnode -light - start a light node that syncs headers and proves the outputs of its wallets")
+    fmt.Println("   startnode also accepts -listen HOST:PORT, -externaladdr HOST:PORT and -connect|-seed HOST:PORT[,HOST:PORT]")
+    fmt.Println("Every command accepts -datadir DIR and -network main|staging|regtest")
 }
 
-func (cli *CommandLine) validateArgs() {
-    if len(os.Args) < 2 {
-        cli.printUsage()
-        runtime.Goexit()
+func exitCode(err error) int {
+    switch {
+    case err == nil:
+        return ExitOK
+    case errors.Is(err, errUsage):
+        return ExitUsage
+    case errors.Is(err, blockchain.ErrNoBlockChain), errors.Is(err, blockchain.ErrBlockChainExists),
+        errors.Is(err, blockchain.ErrWrongNetwork), errors.Is(err, blockchain.ErrLegacyFormat),
+        errors.Is(err, blockchain.ErrWrongGenesis):
+        return ExitNoChain
+    case errors.Is(err, wallet.ErrInvalidAddress), errors.Is(err, wallet.ErrWalletNotFound),
+        errors.Is(err, blockchain.ErrInsufficientFunds), errors.Is(err, blockchain.ErrMissingKey):
+        return ExitBadInput
+    default:
+        return ExitFailure
+    }
+}
+
+func splitAddrs(list string) []string {
+    var addrs []string
+    for _, addr := range strings.Split(list, ",") {
+        if addr = strings.TrimSpace(addr); addr != "" {
+            addrs = append(addrs, addr)
+        }
+    }
+    return addrs
+}
+
+func (cli *CommandLine) newNode(chain *blockchain.BlockChain, opts nodeOptions) (*network.Node, error) {
+    node, err := network.NewNode(chain, opts.externalAddr)
+    if err != nil {
+        return nil, err
+    }
+    node.Listen = opts.listen
+    if len(opts.connect) > 0 {
+        node.Seeds = opts.connect
+        node.ConnectOnly = true
+    } else if len(opts.seeds) > 0 {
+        node.Seeds = opts.seeds
+    }
+    return node, nil
+}
+
+func (cli *CommandLine) openChain(nodeId string) (*blockchain.BlockChain, error) {
+    return blockchain.ContinueBlockChain(cli.dataDir, nodeId, cli.params.Name)
+}
+
+func (cli *CommandLine) openWallets(nodeId string) (*wallet.Wallets, error) {
+    return wallet.CreateWallets(cli.params.DataDir(cli.dataDir), nodeId, cli.params.AddressVersion)
+}
+
+func (cli *CommandLine) checkAddress(address string) error {
+    version, err := wallet.AddressVersion(address)
+    if err != nil {
+        return err
+    }
+    if version != cli.params.AddressVersion {
+        return fmt.Errorf("%w: %s is not a %s address", wallet.ErrInvalidAddress, address, cli.params.Name)
     }
+    return nil
 }
 
-func (cli *CommandLine) printChain(nodeId string) {
-    chain := blockchain.ContinueBlockChain(nodeId)
+func (cli *CommandLine) printChain(nodeId string) error {
+    chain, err := cli.openChain(nodeId)
+    if err != nil {
+        return err
+    }
     defer chain.Database.Close()
     iter := chain.Iterator()
 
     for {
-        block := iter.Next()
-
-        fmt.Printf("Previous Hash: %x\n", block.PrevHash)
-        fmt.Printf("Hash: %x\n", block.Hash)
-        pow:= blockchain.NewProof(block)
-        fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-        for _, tx := range block.Transactions {
-            fmt.Println(tx)
+        block, err := iter.Next()
+        if err != nil {
+            return err
         }
-        fmt.Println()
+        printBlock(block)
 
         if len(block.PrevHash) == 0 {
             break
         }
     }
+    return nil
+}
+
+func printBlock(block *blockchain.Block) {
+    fmt.Printf("Previous Hash: %x\n", block.PrevHash)
+    fmt.Printf("Hash: %x\n", block.Hash)
+    fmt.Printf("Height: %d\n", block.Height)
+    fmt.Printf("Difficulty: %d\n", block.Difficulty)
+    fmt.Printf("Sincerity: %d\n", block.Sincerity)
+    pow:= blockchain.NewProof(&block.BlockHeader)
+    fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+    for _, tx := range block.Transactions {
+        fmt.Println(tx)
+    }
+    fmt.Println()
+}
+
+func (cli *CommandLine) getBlock(height int, hash, nodeId string) error {
+    chain, err := cli.openChain(nodeId)
+    if err != nil {
+        return err
+    }
+    defer chain.Database.Close()
+
+    var block blockchain.Block
+    if hash != "" {
+        blockHash, err := hex.DecodeString(hash)
+        if err != nil {
+            return fmt.Errorf("%w: bad block hash: %s", errUsage, err)
+        }
+        block, err = chain.GetBlock(blockHash)
+        if err != nil {
+            return err
+        }
+    } else {
+        block, err = chain.GetBlockByHeight(height)
+        if err != nil {
+            return err
+        }
+    }
+    printBlock(&block)
+    return nil
 }
 
-func (cli *CommandLine) createBlockChain(address, nodeId string) {
-    if !wallet.ValidateAddress(address) {
-        log.Panic("Address is not Valid")
+func (cli *CommandLine) createBlockChain(nodeId string, txIndex bool) error {
+    chain, err := blockchain.InitBlockChain(cli.dataDir, nodeId, cli.params.Name, txIndex)
+    if err != nil {
+        return err
     }
-    chain := blockchain.InitBlockChain(address, nodeId)
     defer chain.Database.Close()
 
-    UTXOSet := blockchain.UTXOSet{chain}
-    UTXOSet.Reindex()
     fmt.Println("Created Blockchain")
+    return nil
 }
 
-func (cli *CommandLine) getBalance(address, nodeId string) {
-    if !wallet.ValidateAddress(address) {
-        log.Panic("Address is not Valid")
+func (cli *CommandLine) generate(address, nodeId string, blocks int) error {
+    if err := cli.checkAddress(address); err != nil {
+        return err
+    }
+    chain, err := cli.openChain(nodeId)
+    if err != nil {
+        return err
     }
-    chain := blockchain.ContinueBlockChain(nodeId)
-    UTXOSet := blockchain.UTXOSet{chain}
     defer chain.Database.Close()
 
+    for i := 0; i < blocks; i++ {
+        cbTx, err := blockchain.CoinbaseTx(address, "", chain.Params.BlockReward(0))
+        if err != nil {
+            return err
+        }
+        block, stats, err := chain.MineBlock(context.Background(), []*blockchain.Transaction{cbTx}, 0)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Mined block %x at height %d: %s\n", block.Hash, block.Height, stats)
+    }
+    return nil
+}
+
+func (cli *CommandLine) getBalance(address, nodeId string, light bool) error {
+    if err := cli.checkAddress(address); err != nil {
+        return err
+    }
+    pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+    if err != nil {
+        return err
+    }
+
+    var UTXOs []blockchain.TxOutput
+    if light {
+        chain, err := blockchain.OpenLightChain(cli.dataDir, nodeId, cli.params.Name)
+        if err != nil {
+            return err
+        }
+        defer chain.Database.Close()
+        UTXOs, err = chain.ProvenOutputs(pubKeyHash)
+        if err != nil {
+            return err
+        }
+    } else {
+        chain, err := cli.openChain(nodeId)
+        if err != nil {
+            return err
+        }
+        UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+        defer chain.Database.Close()
+        UTXOs, err = UTXOSet.FindUTXO(pubKeyHash)
+        if err != nil {
+            return err
+        }
+    }
+
     balance := 0
-    pubKeyHash := wallet.Base58Decode([]byte(address))
-    pubKeyHash = pubKeyHash[1:len(pubKeyHash)-4]
-    UTXOs := UTXOSet.FindUTXO(pubKeyHash)
 
     for _, out := range UTXOs {
         balance += out.Value
     }
 
     fmt.Printf("Balance of %s: %d\n", address, balance)
+    return nil
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeId string, mineNow bool ) {
-    if !wallet.ValidateAddress(to) {
-        log.Panic("Address is not valid!")
+func (cli *CommandLine) send(from, to string, amount, fee int, nodeId, nodeAddr string, mineNow bool) error {
+    if err := cli.checkAddress(to); err != nil {
+        return err
     }
-    if !wallet.ValidateAddress(from) {
-        log.Panic("Address is not valid!")
+    if err := cli.checkAddress(from); err != nil {
+        return err
     }
 
-    chain := blockchain.ContinueBlockChain(nodeId)
-    UTXOSet := blockchain.UTXOSet{chain}
+    chain, err := cli.openChain(nodeId)
+    if err != nil {
+        return err
+    }
+    UTXOSet := blockchain.UTXOSet{Blockchain: chain}
     defer chain.Database.Close() 
 
-    wallets, err := wallet.CreateWallets(nodeId)
-    //    fmt.Println("test")
+    wallets, err := cli.openWallets(nodeId)
+    if err != nil {
+        return err
+    }
+    wallet, err := wallets.GetWallet(from)
     if err != nil {
-        log.Panic(err)
+        return err
+    }
+    tx, err := blockchain.NewTransaction(&wallet, to, amount, fee, &UTXOSet)
+    if err != nil {
+        return err
     }
-    wallet := wallets.GetWallet(from)
-    tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
     if mineNow {
-        cbTx := blockchain.CoinbaseTx(from, "", 0)
+        cbTx, err := blockchain.CoinbaseTx(from, "", chain.Params.BlockReward(0)+fee)
+        if err != nil {
+            return err
+        }
         txs := []*blockchain.Transaction{cbTx, tx}
-        block := chain.MineBlock(txs)
-        UTXOSet.Update(block)
+        block, stats, err := chain.MineBlock(context.Background(), txs, 0)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Mined block %x: %s\n", block.Hash, stats)
     } else {
-        network.SendTx(network.KnownNodes[0], tx)
+        if err := network.SubmitTx(cli.params, nodeAddr, tx); err != nil {
+            return err
+        }
         fmt.Println("send tx")
     }
 
     fmt.Println("Success!")
+    return nil
 }
  
-func (cli *CommandLine) createWallet(nodeId string) {
-    wallets, _ := wallet.CreateWallets(nodeId)
-    address := wallets.AddWallet()
-    wallets.SaveFile(nodeId)
+func (cli *CommandLine) createWallet(nodeId string) error {
+    wallets, err := cli.openWallets(nodeId)
+    if err != nil {
+        return err
+    }
+    address, err := wallets.AddWallet()
+    if err != nil {
+        return err
+    }
+    if err := wallets.SaveFile(); err != nil {
+        return err
+    }
 
     fmt.Printf("Your wallet address is: %s\n", address)
+    return nil
 }
 
 
-func (cli *CommandLine) listAddresses(nodeId string) {
-    wallets, _ := wallet.CreateWallets(nodeId )
+func (cli *CommandLine) listAddresses(nodeId string) error {
+    wallets, err := cli.openWallets(nodeId)
+    if err != nil {
+        return err
+    }
     addresses := wallets.GetAllAddresses()
 
     for _, address := range addresses {
         fmt.Println(address)
     }
+    return nil
 }
 
-func (cli *CommandLine) reindexUTXO(nodeId string) {
-    chain := blockchain.ContinueBlockChain(nodeId)
+func (cli *CommandLine) reindexUTXO(nodeId string) error {
+    chain, err := cli.openChain(nodeId)
+    if err != nil {
+        return err
+    }
     defer chain.Database.Close()
-    UTXOSet := blockchain.UTXOSet{chain}
-    UTXOSet.Reindex()
+    UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+    if err := UTXOSet.Reindex(); err != nil {
+        return err
+    }
 
-    count := UTXOSet.CountTransactions()
+    count, err := UTXOSet.CountTransactions()
+    if err != nil {
+        return err
+    }
     fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+    return nil
+}
+
+func (cli *CommandLine) reindexTransactions(nodeId string) error {
+    chain, err := cli.openChain(nodeId)
+    if err != nil {
+        return err
+    }
+    defer chain.Database.Close()
+
+    count, err := chain.ReindexTransactions()
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Done! Indexed %d transactions.\n", count)
+    return nil
+}
+
+func (cli *CommandLine) migrateDB(nodeId string) error {
+    wallets, err := cli.openWallets(nodeId)
+    if err != nil {
+        return err
+    }
+    count, err := blockchain.MigrateBlockChain(cli.dataDir, nodeId, cli.params.Name, wallets.Wallets)
+    if err != nil {
+        return err
+    }
+    if count == 0 {
+        fmt.Println("Database is already in the current format.")
+        return nil
+    }
+    fmt.Printf("Done! Re-imported %d legacy blocks.\n", count)
+    return nil
+}
+
+func (cli *CommandLine) getTransaction(id, nodeId string) error {
+    txID, err := hex.DecodeString(id)
+    if err != nil {
+        return fmt.Errorf("%w: bad transaction id: %s", errUsage, err)
+    }
+    chain, err := cli.openChain(nodeId)
+    if err != nil {
+        return err
+    }
+    defer chain.Database.Close()
+
+    tx, header, err := chain.LocateTransaction(txID)
+    if err != nil {
+        return err
+    }
+    bestHeight, err := chain.GetBestHeight()
+    if err != nil {
+        return err
+    }
+
+    fmt.Println(tx)
+    fmt.Printf("Block: %x\n", header.Hash)
+    fmt.Printf("Height: %d\n", header.Height)
+    fmt.Printf("Confirmations: %d\n", bestHeight-header.Height+1)
+    return nil
 }
 
-func (cli *CommandLine) StartNode(nodeId, minerAddress string, sincerity int) {
-    fmt.Printf("Starting Node %s\n", nodeId)
+func (cli *CommandLine) StartNode(nodeId, minerAddress string, sincerity, maxBlockSize, workers int, opts nodeOptions) error {
+    if sincerity < 0 || sincerity > blockchain.MAX_SINCERITY {
+        return fmt.Errorf("%w: sincerity must be between 0 and %d", errUsage, blockchain.MAX_SINCERITY)
+    }
+    if maxBlockSize <= 0 {
+        return fmt.Errorf("%w: maxblocksize must be positive", errUsage)
+    }
+    if workers <= 0 {
+        return fmt.Errorf("%w: workers must be positive", errUsage)
+    }
 
     if len(minerAddress) > 0 {
-        if wallet.ValidateAddress(minerAddress) {
-            fmt.Println("Mining on, receiving reward in: ", minerAddress)
-        } else {
-            log.Panic("Invalid miner address")
+        if err := cli.checkAddress(minerAddress); err != nil {
+            return err
         }
+        fmt.Println("Mining on, receiving reward in: ", minerAddress)
+    }
+
+    chain, err := cli.openChain(nodeId)
+    if err != nil {
+        return err
+    }
+    defer chain.Database.Close()
+
+    node, err := cli.newNode(chain, opts)
+    if err != nil {
+        return err
     }
-    network.StartServer(nodeId, minerAddress, sincerity)
+    node.MinerAddress = minerAddress
+    node.Sincerity = sincerity
+    node.MaxBlockSize = maxBlockSize
+    node.MinerWorkers = workers
+
+    fmt.Printf("Starting Node %s on %s\n", nodeId, node.Listen)
+    return node.ListenAndServe()
 }
 
-func (cli *CommandLine) Run() {
-    cli.validateArgs()
+func (cli *CommandLine) StartLightNode(nodeId string, opts nodeOptions) error {
+    wallets, err := cli.openWallets(nodeId)
+    if err != nil {
+        return err
+    }
+    addresses := wallets.GetAllAddresses()
+    if len(addresses) == 0 {
+        return fmt.Errorf("%w: a light node needs a wallet, run createwallet first", wallet.ErrWalletNotFound)
+    }
 
-    nodeId := os.Getenv("NODE_ID")
-    if nodeId == "" {
-        fmt.Printf("$NODE_ID not set")
-        runtime.Goexit()
+    chain, err := blockchain.OpenLightChain(cli.dataDir, nodeId, cli.params.Name)
+    if err != nil {
+        return err
+    }
+    defer chain.Database.Close()
+
+    node, err := cli.newNode(chain, opts)
+    if err != nil {
+        return err
+    }
+    node.WatchAddresses = addresses
+
+    fmt.Printf("Starting light node %s on %s watching %d addresses\n", nodeId, node.Listen, len(addresses))
+    return node.ListenAndServe()
+}
+
+func (cli *CommandLine) Run() int {
+    if len(os.Args) < 2 {
+        cli.printUsage()
+        return ExitUsage
     }
 
     getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
     createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
+    generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
     sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
     printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+    getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
     createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
     getWalletsCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
     reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+    reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+    migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
+    getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
     startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 
+    commands := map[string]*flag.FlagSet{
+        "getbalance": getBalanceCmd,
+        "createblockchain": createBlockchainCmd,
+        "generate": generateCmd,
+        "send": sendCmd,
+        "printchain": printChainCmd,
+        "getblock": getBlockCmd,
+        "createwallet": createWalletCmd,
+        "getallwallets": getWalletsCmd,
+        "reindexutxo": reindexUTXOCmd,
+        "reindextx": reindexTxCmd,
+        "migratedb": migrateDBCmd,
+        "gettransaction": getTransactionCmd,
+        "startnode": startNodeCmd,
+    }
+    var networkName string
+    for _, cmd := range commands {
+        cmd.StringVar(&cli.dataDir, "datadir", defaultDataDir, "directory holding chain and wallet data")
+        cmd.StringVar(&networkName, "network", blockchain.DefaultNetwork, "chain to use: main, staging or regtest")
+    }
+
     getBalanceAddress := getBalanceCmd.String("address", "", "The address to check")
-    createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send rewards to")
+    getBalanceLight := getBalanceCmd.Bool("light", false, "use the outputs proven by the light node")
+    createBlockchainTxIndex := createBlockchainCmd.Bool("txindex", false, "maintain an index of all transactions")
+    generateAddress := generateCmd.String("address", "", "The address to send rewards to")
+    generateBlocks := generateCmd.Int("blocks", 1, "number of blocks to mine")
     sendFrom := sendCmd.String("from", "", "source wallet")
     sendTo := sendCmd.String("to", "", "destination wallet")
     sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+    sendFee := sendCmd.Int("fee", 0, "fee paid to the miner")
     sendMine := sendCmd.Bool("mine", false, "mine immediately on the same node")
+    sendNode := sendCmd.String("node", "", "address of the node to submit the transaction to (defaults to the first seed)")
+    getBlockHeight := getBlockCmd.Int("height", -1, "height of the block in the main chain")
+    getBlockHash := getBlockCmd.String("hash", "", "hash of the block")
+    getTransactionID := getTransactionCmd.String("id", "", "id of the transaction")
     startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to address")
     sincerityLevel := startNodeCmd.Int("sincerity", 0, "set sincerity level for mining")
-
-    switch os.Args[1] {
-    case "getbalance":
-        err := getBalanceCmd.Parse(os.Args[2:])
-        blockchain.Handle(err)
-    case "createblockchain":
-        err := createBlockchainCmd.Parse(os.Args[2:])
-        blockchain.Handle(err)
-    case "send":
-        err := sendCmd.Parse(os.Args[2:])
-        blockchain.Handle(err)
-    case "printchain":
-        err := printChainCmd.Parse(os.Args[2:])
-        blockchain.Handle(err)
-    case "createwallet":
-        err := createWalletCmd.Parse(os.Args[2:])
-        blockchain.Handle(err)
-    case "getallwallets":
-        err := getWalletsCmd.Parse(os.Args[2:])
-        blockchain.Handle(err)
-    case "reindexutxo":
-        err := reindexUTXOCmd.Parse(os.Args[2:])
-        blockchain.Handle(err)
-    case "startnode":
-        err := startNodeCmd.Parse(os.Args[2:])
-        blockchain.Handle(err)
-    default:
+    maxBlockSize := startNodeCmd.Int("maxblocksize", mempool.DefaultMaxBlockSize, "maximum size in bytes of the transactions in a mined block")
+    minerWorkers := startNodeCmd.Int("workers", runtime.NumCPU(), "number of proof-of-work worker goroutines")
+    startNodeLight := startNodeCmd.Bool("light", false, "sync headers only and verify merkle proofs for wallet outputs")
+    startNodeListen := startNodeCmd.String("listen", "", "address to listen on (defaults to localhost:$NODE_ID)")
+    startNodeExternal := startNodeCmd.String("externaladdr", "", "address advertised to peers (defaults to the listen address)")
+    startNodeConnect := startNodeCmd.String("connect", "", "comma separated peers to connect to exclusively")
+    startNodeSeed := startNodeCmd.String("seed", "", "comma separated peers to bootstrap from instead of the network seeds")
+
+    cmd, ok := commands[os.Args[1]]
+    if !ok {
         cli.printUsage()
-        runtime.Goexit()
+        return ExitUsage
+    }
+    cmd.Parse(os.Args[2:])
+
+    params, err := blockchain.LookupNetwork(networkName)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error:", err)
+        return ExitUsage
     }
+    cli.params = params
 
-    if getBalanceCmd.Parsed() {
+    nodeId := os.Getenv("NODE_ID")
+    if nodeId == "" {
+        nodeId = strconv.Itoa(params.DefaultPort)
+    }
+
+    switch cmd {
+    case getBalanceCmd:
         if *getBalanceAddress == "" {
             getBalanceCmd.Usage()
-            runtime.Goexit()
+            return ExitUsage
         }
-        cli.getBalance(*getBalanceAddress, nodeId)
-    }
-    
-    if createBlockchainCmd.Parsed() {
-        if *createBlockchainAddress == "" {
-            createBlockchainCmd.Usage()
-            runtime.Goexit()
+        err = cli.getBalance(*getBalanceAddress, nodeId, *getBalanceLight)
+    case createBlockchainCmd:
+        err = cli.createBlockChain(nodeId, *createBlockchainTxIndex)
+    case generateCmd:
+        if *generateAddress == "" || *generateBlocks <= 0 {
+            generateCmd.Usage()
+            return ExitUsage
         }
-        cli.createBlockChain(*createBlockchainAddress, nodeId)
-    }
-    if sendCmd.Parsed() {
-        if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+        err = cli.generate(*generateAddress, nodeId, *generateBlocks)
+    case sendCmd:
+        if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
             sendCmd.Usage()
-            runtime.Goexit()
+            return ExitUsage
+        }
+        nodeAddr := *sendNode
+        if nodeAddr == "" {
+            nodeAddr = params.Seeds[0]
+        }
+        err = cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, nodeId, nodeAddr, *sendMine)
+    case printChainCmd:
+        err = cli.printChain(nodeId)
+    case getBlockCmd:
+        if *getBlockHeight < 0 && *getBlockHash == "" {
+            getBlockCmd.Usage()
+            return ExitUsage
+        }
+        err = cli.getBlock(*getBlockHeight, *getBlockHash, nodeId)
+    case createWalletCmd:
+        err = cli.createWallet(nodeId)
+    case getWalletsCmd:
+        err = cli.listAddresses(nodeId)
+    case reindexUTXOCmd:
+        err = cli.reindexUTXO(nodeId)
+    case reindexTxCmd:
+        err = cli.reindexTransactions(nodeId)
+    case migrateDBCmd:
+        err = cli.migrateDB(nodeId)
+    case getTransactionCmd:
+        if *getTransactionID == "" {
+            getTransactionCmd.Usage()
+            return ExitUsage
+        }
+        err = cli.getTransaction(*getTransactionID, nodeId)
+    case startNodeCmd:
+        if *startNodeConnect != "" && *startNodeSeed != "" {
+            fmt.Fprintln(os.Stderr, "Error: -connect and -seed cannot be combined")
+            return ExitUsage
+        }
+        opts := nodeOptions{
+            listen: *startNodeListen,
+            externalAddr: *startNodeExternal,
+            connect: splitAddrs(*startNodeConnect),
+            seeds: splitAddrs(*startNodeSeed),
+        }
+        if opts.listen == "" {
+            opts.listen = "localhost:" + nodeId
+        }
+        if opts.externalAddr == "" {
+            opts.externalAddr = opts.listen
         }
-        cli.send(*sendFrom, *sendTo, *sendAmount, nodeId, *sendMine)
-    }
-    
-    if printChainCmd.Parsed() {
-        cli.printChain(nodeId)
-    }
-    
-    if createWalletCmd.Parsed() {
-        cli.createWallet(nodeId)
-    }
 
-    if getWalletsCmd.Parsed() {
-        cli.listAddresses(nodeId)
-    }
-    if reindexUTXOCmd.Parsed() {
-        cli.reindexUTXO(nodeId)
-    }
-    if startNodeCmd.Parsed() {
-        cli.StartNode(nodeId, *startNodeMiner, *sincerityLevel)
+        if *startNodeLight {
+            if *startNodeMiner != "" {
+                fmt.Fprintln(os.Stderr, "Error: a light node cannot mine")
+                return ExitUsage
+            }
+            err = cli.StartLightNode(nodeId, opts)
+        } else {
+            err = cli.StartNode(nodeId, *startNodeMiner, *sincerityLevel, *maxBlockSize, *minerWorkers, opts)
+        }
     }
 
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error:", err)
+    }
+    return exitCode(err)
 }
-
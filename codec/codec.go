@@ -0,0 +1,159 @@
+package codec
+
+import (
+    "encoding/binary"
+    "errors"
+)
+
+const MaxBytesLength = 32 << 20
+
+var (
+    ErrShortBuffer = errors.New("unexpected end of data")
+    ErrTooLarge = errors.New("length exceeds the remaining data")
+    ErrTrailingData = errors.New("unexpected data after the end of the value")
+)
+
+type Writer struct {
+    buf []byte
+}
+
+type Reader struct {
+    data []byte
+    err error
+}
+
+func NewWriter() *Writer {
+    return &Writer{}
+}
+
+func (w *Writer) PutUint8(v uint8) {
+    w.buf = append(w.buf, v)
+}
+
+func (w *Writer) PutUint32(v uint32) {
+    var b [4]byte
+    binary.BigEndian.PutUint32(b[:], v)
+    w.buf = append(w.buf, b[:]...)
+}
+
+func (w *Writer) PutUint64(v uint64) {
+    var b [8]byte
+    binary.BigEndian.PutUint64(b[:], v)
+    w.buf = append(w.buf, b[:]...)
+}
+
+func (w *Writer) PutInt32(v int32) {
+    w.PutUint32(uint32(v))
+}
+
+func (w *Writer) PutInt64(v int64) {
+    w.PutUint64(uint64(v))
+}
+
+func (w *Writer) PutBytes(b []byte) {
+    w.PutUint32(uint32(len(b)))
+    w.buf = append(w.buf, b...)
+}
+
+func (w *Writer) PutString(s string) {
+    w.PutBytes([]byte(s))
+}
+
+func (w *Writer) Bytes() []byte {
+    return w.buf
+}
+
+func NewReader(data []byte) *Reader {
+    return &Reader{data: data}
+}
+
+func (r *Reader) next(n int) []byte {
+    if r.err != nil {
+        return nil
+    }
+    if len(r.data) < n {
+        r.err = ErrShortBuffer
+        r.data = nil
+        return nil
+    }
+    b := r.data[:n]
+    r.data = r.data[n:]
+    return b
+}
+
+func (r *Reader) Uint8() uint8 {
+    b := r.next(1)
+    if b == nil {
+        return 0
+    }
+    return b[0]
+}
+
+func (r *Reader) Uint32() uint32 {
+    b := r.next(4)
+    if b == nil {
+        return 0
+    }
+    return binary.BigEndian.Uint32(b)
+}
+
+func (r *Reader) Uint64() uint64 {
+    b := r.next(8)
+    if b == nil {
+        return 0
+    }
+    return binary.BigEndian.Uint64(b)
+}
+
+func (r *Reader) Int32() int32 {
+    return int32(r.Uint32())
+}
+
+func (r *Reader) Int64() int64 {
+    return int64(r.Uint64())
+}
+
+func (r *Reader) Bytes() []byte {
+    n := r.Uint32()
+    if r.err != nil {
+        return nil
+    }
+    if n > MaxBytesLength || int(n) > len(r.data) {
+        r.err = ErrTooLarge
+        return nil
+    }
+    if n == 0 {
+        return nil
+    }
+    return append([]byte{}, r.next(int(n))...)
+}
+
+func (r *Reader) String() string {
+    return string(r.Bytes())
+}
+
+func (r *Reader) Count() int {
+    n := r.Uint32()
+    if r.err != nil {
+        return 0
+    }
+    if int(n) > len(r.data) {
+        r.err = ErrTooLarge
+        return 0
+    }
+    return int(n)
+}
+
+func (r *Reader) Err() error {
+    return r.err
+}
+
+func (r *Reader) Finish() error {
+    if r.err != nil {
+        return r.err
+    }
+    if len(r.data) > 0 {
+        return ErrTrailingData
+    }
+    return nil
+}
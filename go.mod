@@ -2,16 +2,18 @@ module github.com/viscory/reciprocus
 
 go 1.17
 
-require github.com/dgraph-io/badger v1.5.4
+require (
+	github.com/dgraph-io/badger v1.5.4
+	github.com/mr-tron/base58 v1.2.0
+	github.com/vrecan/death/v3 v3.0.3
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+)
 
 require (
 	github.com/AndreasBriese/bbloom v0.0.0-20180913140656-343706a395b7 // indirect
 	github.com/dgryski/go-farm v0.0.0-20180109070241-2de33835d102 // indirect
 	github.com/golang/protobuf v1.2.0 // indirect
-	github.com/mr-tron/base58 v1.2.0 // indirect
 	github.com/pkg/errors v0.8.0 // indirect
-	github.com/vrecan/death/v3 v3.0.3 // indirect
-	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871 // indirect
 	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
 	golang.org/x/sys v0.0.0-20211124211545-fe61309f8881 // indirect
 )
@@ -6,8 +6,6 @@ import (
 )
 
 func main() {
-    defer os.Exit(0)
-    
     cli := cli.CommandLine{}
-    cli.Run()
+    os.Exit(cli.Run())
 }
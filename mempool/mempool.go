@@ -0,0 +1,248 @@
+package mempool
+
+import (
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "sort"
+    "sync"
+
+    "github.com/viscory/reciprocus/blockchain"
+)
+
+const DefaultMaxSize = 8 << 20
+
+var (
+    ErrAlreadyKnown = errors.New("transaction is already in the pool")
+    ErrCoinbase = errors.New("coinbase transactions are only valid in blocks")
+    ErrConflict = errors.New("transaction conflicts with the pool")
+    ErrPoolFull = errors.New("transaction fee rate is too low for the full pool")
+)
+
+type Entry struct {
+    Tx *blockchain.Transaction
+    Fee int
+    Size int
+    seq uint64
+}
+
+type Pool struct {
+    chain *blockchain.BlockChain
+    maxSize int
+
+    mu sync.Mutex
+    entries map[string]*Entry
+    spent map[string]string
+    size int
+    seq uint64
+}
+
+func New(chain *blockchain.BlockChain, maxSize int) *Pool {
+    return &Pool{
+        chain: chain,
+        maxSize: maxSize,
+        entries: make(map[string]*Entry),
+        spent: make(map[string]string),
+    }
+}
+
+func outpoint(txID []byte, index int) string {
+    return fmt.Sprintf("%x:%d", txID, index)
+}
+
+func (e *Entry) lessRate(other *Entry) bool {
+    return e.Fee*other.Size < other.Fee*e.Size
+}
+
+func (p *Pool) Len() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return len(p.entries)
+}
+
+func (p *Pool) Size() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.size
+}
+
+func (p *Pool) Has(txID []byte) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    _, ok := p.entries[hex.EncodeToString(txID)]
+    return ok
+}
+
+func (p *Pool) Get(txID []byte) (blockchain.Transaction, bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    entry, ok := p.entries[hex.EncodeToString(txID)]
+    if !ok {
+        return blockchain.Transaction{}, false
+    }
+    return *entry.Tx, true
+}
+
+func (p *Pool) Entries() []*Entry {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.sorted()
+}
+
+func (p *Pool) sorted() []*Entry {
+    entries := make([]*Entry, 0, len(p.entries))
+    for _, entry := range p.entries {
+        entries = append(entries, entry)
+    }
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].seq < entries[j].seq
+    })
+    return entries
+}
+
+func (p *Pool) Add(tx *blockchain.Transaction) (*Entry, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    entry, err := p.add(tx)
+    if err != nil {
+        return nil, err
+    }
+    p.trim()
+    if _, ok := p.entries[hex.EncodeToString(tx.ID)]; !ok {
+        return nil, fmt.Errorf("%w: tx %x", ErrPoolFull, tx.ID)
+    }
+    return entry, nil
+}
+
+func (p *Pool) add(tx *blockchain.Transaction) (*Entry, error) {
+    key := hex.EncodeToString(tx.ID)
+    if _, ok := p.entries[key]; ok {
+        return nil, fmt.Errorf("%w: tx %x", ErrAlreadyKnown, tx.ID)
+    }
+    if tx.IsCoinBase() {
+        return nil, fmt.Errorf("%w: tx %x", ErrCoinbase, tx.ID)
+    }
+    if err := p.chain.Params.CheckTransaction(tx); err != nil {
+        return nil, err
+    }
+
+    for _, in := range tx.Inputs {
+        if spender, ok := p.spent[outpoint(in.ID, in.Out)]; ok {
+            return nil, fmt.Errorf("%w: %x:%d is spent by %s", ErrConflict, in.ID, in.Out, spender)
+        }
+    }
+    fee, err := p.chain.Params.CheckTransactionInputs(tx, p.lookup)
+    if err != nil {
+        return nil, err
+    }
+
+    p.seq++
+    entry := &Entry{Tx: tx, Fee: fee, Size: len(tx.Serialize()), seq: p.seq}
+    p.entries[key] = entry
+    for _, in := range tx.Inputs {
+        p.spent[outpoint(in.ID, in.Out)] = key
+    }
+    p.size += entry.Size
+    return entry, nil
+}
+
+func (p *Pool) lookup(in blockchain.TxInput) (blockchain.TxOutput, blockchain.Transaction, error) {
+    parent, ok := p.entries[hex.EncodeToString(in.ID)]
+    if !ok {
+        return p.chain.LookupUnspent(in)
+    }
+    if in.Out < 0 || in.Out >= len(parent.Tx.Outputs) {
+        return blockchain.TxOutput{}, blockchain.Transaction{}, fmt.Errorf("%w: %x:%d", blockchain.ErrDoubleSpend, in.ID, in.Out)
+    }
+    return parent.Tx.Outputs[in.Out], *parent.Tx, nil
+}
+
+func (p *Pool) trim() {
+    for p.size > p.maxSize && len(p.entries) > 0 {
+        var lowest *Entry
+        for _, entry := range p.entries {
+            if lowest == nil || entry.lessRate(lowest) {
+                lowest = entry
+            }
+        }
+        p.remove(lowest.Tx.ID)
+    }
+}
+
+func (p *Pool) Remove(txID []byte) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.remove(txID)
+}
+
+func (p *Pool) remove(txID []byte) {
+    key := hex.EncodeToString(txID)
+    entry, ok := p.entries[key]
+    if !ok {
+        return
+    }
+    delete(p.entries, key)
+    p.size -= entry.Size
+    for _, in := range entry.Tx.Inputs {
+        delete(p.spent, outpoint(in.ID, in.Out))
+    }
+
+    for i := range entry.Tx.Outputs {
+        if child, ok := p.spent[outpoint(txID, i)]; ok {
+            childID, _ := hex.DecodeString(child)
+            p.remove(childID)
+        }
+    }
+}
+
+func (p *Pool) BlockConnected(block *blockchain.Block) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    for _, tx := range block.Transactions {
+        key := hex.EncodeToString(tx.ID)
+        if entry, ok := p.entries[key]; ok {
+            delete(p.entries, key)
+            p.size -= entry.Size
+            for _, in := range entry.Tx.Inputs {
+                delete(p.spent, outpoint(in.ID, in.Out))
+            }
+            continue
+        }
+        if tx.IsCoinBase() {
+            continue
+        }
+        for _, in := range tx.Inputs {
+            if spender, ok := p.spent[outpoint(in.ID, in.Out)]; ok {
+                spenderID, _ := hex.DecodeString(spender)
+                p.remove(spenderID)
+            }
+        }
+    }
+}
+
+func (p *Pool) Revalidate() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    pending := p.sorted()
+    p.entries = make(map[string]*Entry)
+    p.spent = make(map[string]string)
+    p.size = 0
+
+    for progress := true; progress && len(pending) > 0; {
+        progress = false
+        var retry []*Entry
+        for _, entry := range pending {
+            if _, err := p.add(entry.Tx); err != nil {
+                retry = append(retry, entry)
+                continue
+            }
+            progress = true
+        }
+        pending = retry
+    }
+    p.trim()
+    return len(pending)
+}
@@ -0,0 +1,199 @@
+package mempool
+
+import (
+    "container/heap"
+    "encoding/hex"
+    "sort"
+
+    "github.com/viscory/reciprocus/blockchain"
+)
+
+const DefaultMaxBlockSize = 1 << 20
+
+type Template struct {
+    Transactions []*blockchain.Transaction
+    Fees int
+    Size int
+}
+
+type candidate struct {
+    entry *Entry
+    key string
+    parents []*candidate
+    children []*candidate
+    ancestors map[string]*candidate
+    depth int
+    fee int
+    size int
+    included bool
+    index int
+}
+
+type candidateQueue []*candidate
+
+func (q candidateQueue) Len() int {
+    return len(q)
+}
+
+func (q candidateQueue) Less(i, j int) bool {
+    a, b := q[i], q[j]
+    if a.fee*b.size != b.fee*a.size {
+        return a.fee*b.size > b.fee*a.size
+    }
+    return a.entry.seq < b.entry.seq
+}
+
+func (q candidateQueue) Swap(i, j int) {
+    q[i], q[j] = q[j], q[i]
+    q[i].index = i
+    q[j].index = j
+}
+
+func (q *candidateQueue) Push(x interface{}) {
+    c := x.(*candidate)
+    c.index = len(*q)
+    *q = append(*q, c)
+}
+
+func (q *candidateQueue) Pop() interface{} {
+    old := *q
+    c := old[len(old)-1]
+    c.index = -1
+    *q = old[:len(old)-1]
+    return c
+}
+
+func (c *candidate) collectAncestors() map[string]*candidate {
+    if c.ancestors != nil {
+        return c.ancestors
+    }
+    c.ancestors = make(map[string]*candidate)
+    for _, parent := range c.parents {
+        c.ancestors[parent.key] = parent
+        for key, ancestor := range parent.collectAncestors() {
+            c.ancestors[key] = ancestor
+        }
+        if parent.depth+1 > c.depth {
+            c.depth = parent.depth + 1
+        }
+    }
+    return c.ancestors
+}
+
+func (c *candidate) descendants() []*candidate {
+    seen := map[string]bool{c.key: true}
+    queue := append([]*candidate{}, c.children...)
+    var found []*candidate
+    for len(queue) > 0 {
+        d := queue[0]
+        queue = queue[1:]
+        if seen[d.key] {
+            continue
+        }
+        seen[d.key] = true
+        found = append(found, d)
+        queue = append(queue, d.children...)
+    }
+    return found
+}
+
+func (p *Pool) candidates() map[string]*candidate {
+    candidates := make(map[string]*candidate, len(p.entries))
+    for key, entry := range p.entries {
+        candidates[key] = &candidate{entry: entry, key: key, index: -1}
+    }
+    for _, c := range candidates {
+        linked := make(map[string]bool)
+        for _, in := range c.entry.Tx.Inputs {
+            key := hex.EncodeToString(in.ID)
+            parent, ok := candidates[key]
+            if !ok || linked[key] {
+                continue
+            }
+            linked[key] = true
+            c.parents = append(c.parents, parent)
+            parent.children = append(parent.children, c)
+        }
+    }
+    for _, c := range candidates {
+        c.fee, c.size = c.entry.Fee, c.entry.Size
+        for _, ancestor := range c.collectAncestors() {
+            c.fee += ancestor.entry.Fee
+            c.size += ancestor.entry.Size
+        }
+    }
+    return candidates
+}
+
+func (p *Pool) BlockTemplate(minerAddress string, sincerity, maxSize int) (*Template, error) {
+    reward := p.chain.Params.BlockReward(sincerity)
+    probe, err := blockchain.CoinbaseTx(minerAddress, "", reward)
+    if err != nil {
+        return nil, err
+    }
+    t := &Template{Size: len(probe.Serialize())}
+
+    p.mu.Lock()
+    candidates := p.candidates()
+    p.mu.Unlock()
+
+    queue := make(candidateQueue, 0, len(candidates))
+    for _, c := range candidates {
+        heap.Push(&queue, c)
+    }
+    var selected []*candidate
+    for queue.Len() > 0 {
+        best := heap.Pop(&queue).(*candidate)
+        if t.Size+best.size > maxSize {
+            continue
+        }
+
+        pkg := []*candidate{best}
+        for _, ancestor := range best.ancestors {
+            if !ancestor.included {
+                pkg = append(pkg, ancestor)
+            }
+        }
+        for _, c := range pkg {
+            c.included = true
+            if c.index >= 0 {
+                heap.Remove(&queue, c.index)
+            }
+        }
+        selected = append(selected, pkg...)
+        t.Fees += best.fee
+        t.Size += best.size
+
+        for _, c := range pkg {
+            for _, d := range c.descendants() {
+                if d.included {
+                    continue
+                }
+                d.fee -= c.entry.Fee
+                d.size -= c.entry.Size
+                if d.index >= 0 {
+                    heap.Fix(&queue, d.index)
+                } else {
+                    heap.Push(&queue, d)
+                }
+            }
+        }
+    }
+
+    sort.Slice(selected, func(i, j int) bool {
+        if selected[i].depth != selected[j].depth {
+            return selected[i].depth < selected[j].depth
+        }
+        return selected[i].entry.seq < selected[j].entry.seq
+    })
+
+    coinbase, err := blockchain.CoinbaseTx(minerAddress, "", reward+t.Fees)
+    if err != nil {
+        return nil, err
+    }
+    t.Transactions = append(t.Transactions, coinbase)
+    for _, c := range selected {
+        t.Transactions = append(t.Transactions, c.entry.Tx)
+    }
+    return t, nil
+}
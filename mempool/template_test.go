@@ -0,0 +1,82 @@
+package mempool
+
+import (
+    "context"
+    "encoding/hex"
+    "testing"
+
+    "github.com/viscory/reciprocus/blockchain"
+    "github.com/viscory/reciprocus/storage"
+    "github.com/viscory/reciprocus/wallet"
+)
+
+func spend(t *testing.T, parent *blockchain.Transaction, w *wallet.Wallet, to string, amount int) *blockchain.Transaction {
+    out, err := blockchain.NewTxOutput(amount, to)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tx := blockchain.Transaction{Inputs: []blockchain.TxInput{{ID: parent.ID, Out: 0, PubKey: w.PublicKey}}, Outputs: []blockchain.TxOutput{*out}}
+    if err := tx.Sign(w.PrivateKey, map[string]blockchain.Transaction{hex.EncodeToString(parent.ID): *parent}); err != nil {
+        t.Fatal(err)
+    }
+    return &tx
+}
+
+func TestBlockTemplatePrefersPackageFeeRate(t *testing.T) {
+    chain, err := blockchain.NewBlockChain(storage.NewMemory(), "regtest", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    w, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := string(w.VersionedAddress(chain.Params.AddressVersion))
+    reward := chain.Params.BlockReward(0)
+
+    var coinbases []*blockchain.Transaction
+    for i := 0; i < 2; i++ {
+        coinbase, err := blockchain.CoinbaseTx(addr, "", reward)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, _, err := chain.MineBlock(context.Background(), []*blockchain.Transaction{coinbase}, 0); err != nil {
+            t.Fatal(err)
+        }
+        coinbases = append(coinbases, coinbase)
+    }
+
+    pool := New(chain, DefaultMaxSize)
+    parent := spend(t, coinbases[0], w, addr, reward-1)
+    child := spend(t, parent, w, addr, reward-501)
+    single := spend(t, coinbases[1], w, addr, reward-100)
+    for _, tx := range []*blockchain.Transaction{parent, child, single} {
+        if _, err := pool.Add(tx); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    probe, err := blockchain.CoinbaseTx(addr, "", reward)
+    if err != nil {
+        t.Fatal(err)
+    }
+    maxSize := len(probe.Serialize()) + len(parent.Serialize()) + len(child.Serialize())
+    template, err := pool.BlockTemplate(addr, 0, maxSize)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(template.Transactions) != 3 || template.Fees != 501 {
+        t.Fatalf("template has %d transactions and %d in fees, want the parent and child package with 501", len(template.Transactions), template.Fees)
+    }
+    if string(template.Transactions[1].ID) != string(parent.ID) || string(template.Transactions[2].ID) != string(child.ID) {
+        t.Error("parent must precede its child in the template")
+    }
+
+    template, err = pool.BlockTemplate(addr, 0, DefaultMaxBlockSize)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(template.Transactions) != 4 || template.Fees != 601 {
+        t.Errorf("template has %d transactions and %d in fees, want all three with 601", len(template.Transactions), template.Fees)
+    }
+}
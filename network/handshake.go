@@ -0,0 +1,256 @@
+package network
+
+import (
+    "github.com/viscory/reciprocus/blockchain"
+    "github.com/viscory/reciprocus/codec"
+
+    "bytes"
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "time"
+)
+
+const (
+    UserAgent = "/reciprocus:0.2.0/"
+    ServiceBlocks uint64 = 1 << 0
+    ServiceProofs uint64 = 1 << 1
+    handshakeTimeout = 30 * time.Second
+)
+
+var ErrHandshake = errors.New("handshake failed")
+
+type Version struct {
+    Version int
+    Services uint64
+    Genesis []byte
+    UserAgent string
+    BestHeight int
+    Nonce uint64
+    AddrFrom string
+}
+
+type Verack struct{}
+
+func (m *Version) Encode(w *codec.Writer) {
+    w.PutUint32(uint32(m.Version))
+    w.PutUint64(m.Services)
+    w.PutBytes(m.Genesis)
+    w.PutString(m.UserAgent)
+    w.PutUint64(uint64(m.BestHeight))
+    w.PutUint64(m.Nonce)
+    w.PutString(m.AddrFrom)
+}
+
+func (m *Version) Decode(r *codec.Reader) {
+    m.Version = int(r.Uint32())
+    m.Services = r.Uint64()
+    m.Genesis = r.Bytes()
+    m.UserAgent = r.String()
+    m.BestHeight = int(r.Uint64())
+    m.Nonce = r.Uint64()
+    m.AddrFrom = r.String()
+}
+
+func (m *Verack) Encode(w *codec.Writer) {}
+
+func (m *Verack) Decode(r *codec.Reader) {}
+
+func newNonce() (uint64, error) {
+    var buf [8]byte
+    if _, err := rand.Read(buf[:]); err != nil {
+        return 0, err
+    }
+    return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func (n *Node) dial(addr string) {
+    if _, err := n.Connect(addr); err != nil {
+        n.removeKnownNode(addr)
+        log.Printf("%s is not available: %s\n", addr, err)
+    }
+}
+
+func (n *Node) genesisHash() ([]byte, error) {
+    return hex.DecodeString(n.Chain.Params.Genesis.Hash)
+}
+
+func (n *Node) localVersion() (*Version, error) {
+    genesis, err := n.genesisHash()
+    if err != nil {
+        return nil, err
+    }
+    n.mu.Lock()
+    bestHeight := n.bestHeight
+    n.mu.Unlock()
+
+    v := &Version{
+        Version: version,
+        Genesis: genesis,
+        UserAgent: UserAgent,
+        BestHeight: bestHeight,
+        Nonce: n.nonce,
+        AddrFrom: n.Address,
+    }
+    if !n.Chain.Light {
+        v.Services |= ServiceBlocks
+    }
+    if n.Chain.TxIndex {
+        v.Services |= ServiceProofs
+    }
+    return v, nil
+}
+
+func (n *Node) pushVersion(p *Peer) error {
+    n.mu.Lock()
+    sent := p.versionSent
+    p.versionSent = true
+    n.mu.Unlock()
+    if sent {
+        return nil
+    }
+
+    v, err := n.localVersion()
+    if err != nil {
+        return err
+    }
+    return p.sendControl("version", v)
+}
+
+func (n *Node) checkVersion(p *Peer, v *Version) error {
+    if v.Nonce == n.nonce {
+        if !p.Inbound {
+            n.removeKnownNode(p.Addr())
+        }
+        return fmt.Errorf("%w: connected to self", ErrHandshake)
+    }
+    if v.Version < minVersion {
+        return fmt.Errorf("%w: protocol version %d is not supported", ErrHandshake, v.Version)
+    }
+    if v.Genesis == nil {
+        if v.Services&ServiceBlocks != 0 {
+            return fmt.Errorf("%w: peer serves blocks but announced no genesis", ErrHandshake)
+        }
+        return nil
+    }
+
+    genesis, err := n.genesisHash()
+    if err != nil {
+        return err
+    }
+    if !bytes.Equal(genesis, v.Genesis) {
+        return fmt.Errorf("%w: peer follows a chain with genesis %x", ErrHandshake, v.Genesis)
+    }
+    return nil
+}
+
+func (n *Node) HandleVersion(p *Peer, request []byte) error {
+    var payload Version
+
+    if err := DecodePayload(request, &payload); err != nil {
+        return fmt.Errorf("%w: %s", ErrHandshake, err)
+    }
+
+    n.mu.Lock()
+    duplicate := p.version != nil
+    if !duplicate {
+        p.version = &payload
+    }
+    n.mu.Unlock()
+    if duplicate {
+        return fmt.Errorf("%w: duplicate version message", ErrHandshake)
+    }
+    if err := n.checkVersion(p, &payload); err != nil {
+        return err
+    }
+
+    if err := n.pushVersion(p); err != nil {
+        return err
+    }
+    if err := p.sendControl("verack", &Verack{}); err != nil {
+        return err
+    }
+    return n.completeHandshake(p)
+}
+
+func (n *Node) HandleVerack(p *Peer, request []byte) error {
+    n.mu.Lock()
+    duplicate := p.verackReceived || !p.versionSent
+    p.verackReceived = true
+    n.mu.Unlock()
+    if duplicate {
+        return fmt.Errorf("%w: unexpected verack", ErrHandshake)
+    }
+    return n.completeHandshake(p)
+}
+
+func (n *Node) completeHandshake(p *Peer) error {
+    n.mu.Lock()
+    v := p.version
+    done := v != nil && p.verackReceived
+    n.mu.Unlock()
+    if !done {
+        return nil
+    }
+    p.readyOnce.Do(func() { close(p.ready) })
+
+    fmt.Printf("Connected to %s %s (version %d, height %d)\n", p, v.UserAgent, v.Version, v.BestHeight)
+    if n.addKnownNode(v.AddrFrom) && !n.ConnectOnly {
+        n.sendAddr(p)
+    }
+    if v.Services&ServiceBlocks == 0 {
+        return nil
+    }
+
+    if n.Chain.Light {
+        return n.requestHeaders(p)
+    }
+    bestHeight, err := n.Chain.GetBestHeight()
+    if err != nil {
+        return err
+    }
+    if v.BestHeight > bestHeight {
+        return n.syncFrom(p)
+    }
+    return nil
+}
+
+func SubmitTx(params blockchain.ChainParams, addr string, txn *blockchain.Transaction) error {
+    conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+    nonce, err := newNonce()
+    if err != nil {
+        return err
+    }
+    v := Version{Version: version, UserAgent: UserAgent, Nonce: nonce}
+    if err := WriteMessage(conn, params.Magic, "version", EncodePayload(&v)); err != nil {
+        return err
+    }
+
+    gotVersion, gotVerack := false, false
+    for !gotVersion || !gotVerack {
+        command, _, err := ReadMessage(conn, params.Magic)
+        if err != nil {
+            return fmt.Errorf("%w: %s", ErrHandshake, err)
+        }
+        switch command {
+        case "version":
+            gotVersion = true
+            if err := WriteMessage(conn, params.Magic, "verack", EncodePayload(&Verack{})); err != nil {
+                return err
+            }
+        case "verack":
+            gotVerack = true
+        }
+    }
+    return WriteMessage(conn, params.Magic, "tx", EncodePayload(&Tx{"", txn.Serialize()}))
+}
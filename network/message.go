@@ -0,0 +1,74 @@
+package network
+
+import (
+    "github.com/viscory/reciprocus/codec"
+
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+)
+
+const (
+    checksumLength = 4
+    headerLength = 4 + commandLength + 4 + checksumLength
+    MaxMessageSize = codec.MaxBytesLength
+)
+
+var (
+    ErrBadMagic = errors.New("message is for another network")
+    ErrBadChecksum = errors.New("message checksum does not match its payload")
+    ErrMessageTooLarge = errors.New("message payload is too large")
+)
+
+func checksum(payload []byte) []byte {
+    first := sha256.Sum256(payload)
+    second := sha256.Sum256(first[:])
+    return second[:checksumLength]
+}
+
+func WriteMessage(w io.Writer, magic uint32, command string, payload []byte) error {
+    if len(command) > commandLength {
+        return fmt.Errorf("%w: %q", ErrUnknownCommand, command)
+    }
+    if len(payload) > MaxMessageSize {
+        return fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, len(payload))
+    }
+
+    message := make([]byte, headerLength, headerLength+len(payload))
+    binary.BigEndian.PutUint32(message[0:4], magic)
+    copy(message[4:4+commandLength], CmdToBytes(command))
+    binary.BigEndian.PutUint32(message[4+commandLength:8+commandLength], uint32(len(payload)))
+    copy(message[8+commandLength:], checksum(payload))
+    message = append(message, payload...)
+
+    _, err := w.Write(message)
+    return err
+}
+
+func ReadMessage(r io.Reader, magic uint32) (string, []byte, error) {
+    header := make([]byte, headerLength)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return "", nil, err
+    }
+
+    if got := binary.BigEndian.Uint32(header[0:4]); got != magic {
+        return "", nil, fmt.Errorf("%w: magic %08x", ErrBadMagic, got)
+    }
+    command := BytesToCmd(header[4:4+commandLength])
+    length := binary.BigEndian.Uint32(header[4+commandLength:8+commandLength])
+    if length > MaxMessageSize {
+        return "", nil, fmt.Errorf("%w: %s with %d bytes", ErrMessageTooLarge, command, length)
+    }
+
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        return "", nil, err
+    }
+    if !bytes.Equal(checksum(payload), header[8+commandLength:]) {
+        return "", nil, fmt.Errorf("%w: %s", ErrBadChecksum, command)
+    }
+    return command, payload, nil
+}
@@ -0,0 +1,103 @@
+package network
+
+import (
+    "github.com/viscory/reciprocus/blockchain"
+    "github.com/viscory/reciprocus/mempool"
+
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "log"
+)
+
+type miningJob struct {
+    block *blockchain.Block
+    template *mempool.Template
+    cancel context.CancelFunc
+    done chan struct{}
+}
+
+func (n *Node) MineTx() error {
+    if n.mining != nil || n.closed || n.Pool.Len() == 0 {
+        return nil
+    }
+
+    template, err := n.Pool.BlockTemplate(n.MinerAddress, n.Sincerity, n.MaxBlockSize)
+    if err != nil {
+        return err
+    }
+    if len(template.Transactions) == 1 {
+        fmt.Println("No transaction fits in a block")
+        return nil
+    }
+    for _, tx := range template.Transactions[1:] {
+        fmt.Printf("tx: %x\n", tx.ID)
+    }
+
+    block, err := n.Chain.PrepareBlock(template.Transactions, n.Sincerity)
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    job := &miningJob{block, template, cancel, make(chan struct{})}
+    n.mining = job
+    go n.mine(ctx, job)
+    return nil
+}
+
+func (n *Node) mine(ctx context.Context, job *miningJob) {
+    defer close(job.done)
+    stats, err := job.block.Mine(ctx, n.MinerWorkers)
+
+    n.chainMu.Lock()
+    n.mined(job, stats, err)
+    outbox := n.takeOutbox()
+    n.chainMu.Unlock()
+
+    deliver(outbox)
+}
+
+func (n *Node) mined(job *miningJob, stats blockchain.MiningStats, err error) {
+    if n.mining == job {
+        n.mining = nil
+    }
+    if errors.Is(err, context.Canceled) {
+        fmt.Printf("Mining of block %d stopped after %s\n", job.block.Height, stats)
+        return
+    }
+    if err != nil {
+        log.Printf("mining failed: %s\n", err)
+        return
+    }
+    if n.closed || !bytes.Equal(n.Chain.LastHash, job.block.PrevHash) {
+        return
+    }
+
+    if err := n.Chain.AddBlock(job.block); err != nil {
+        log.Printf("mined block %x rejected: %s\n", job.block.Hash, err)
+        return
+    }
+    n.updateBestHeight()
+    fmt.Printf("New block mined with %d transactions, %d bytes and %d in fees: %s\n",
+        len(job.template.Transactions)-1, job.template.Size, job.template.Fees, stats)
+    n.broadcastInv("block", job.block.Hash, nil)
+
+    if err := n.MineTx(); err != nil {
+        log.Printf("mining failed: %s\n", err)
+    }
+}
+
+func (n *Node) restartMining() {
+    if n.mining != nil {
+        n.mining.cancel()
+        n.mining = nil
+    }
+    if len(n.MinerAddress) == 0 {
+        return
+    }
+    if err := n.MineTx(); err != nil {
+        log.Printf("mining failed: %s\n", err)
+    }
+}
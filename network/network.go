@@ -3,35 +3,70 @@ package network
 import (
     "github.com/vrecan/death/v3"
     "github.com/viscory/reciprocus/blockchain"
+    "github.com/viscory/reciprocus/codec"
+    "github.com/viscory/reciprocus/mempool"
 
-    "encoding/gob"
-    "encoding/hex"
-    "io/ioutil"
-
+    "bytes"
+    "errors"
     "fmt"
-    "runtime"
     "os"
-    "bytes"
     "net"
+    "runtime"
+    "sync"
     "syscall"
     "log"
-    "io"
 )
 
 const (
     protocol = "tcp"
-    version = 1
+    version = 4
+    minVersion = 4
     commandLength = 12
+    maxAddrs = 1000
+    maxKnownNodes = 1000
 )
 
 var (
-    nodeAddress string
-    mineAddress string
-    KnownNodes  = []string{"localhost:3000"}
-    blocksInTransit = [][]byte{}
-    memoryPool = make(map[string]blockchain.Transaction)
+    ErrUnknownCommand = errors.New("unknown command")
+    ErrBadPayload = errors.New("malformed message payload")
+    ErrNodeClosed = errors.New("node is closed")
 )
 
+type Node struct {
+    Address string
+    Listen string
+    Seeds []string
+    ConnectOnly bool
+    MinerAddress string
+    Sincerity int
+    MaxBlockSize int
+    MinerWorkers int
+    WatchAddresses []string
+    Chain *blockchain.BlockChain
+    Pool *mempool.Pool
+
+    nonce uint64
+    quit chan struct{}
+    chainMu sync.Mutex
+    closed bool
+    orphans *orphanPool
+    mining *miningJob
+    outbox []outMessage
+
+    mu sync.Mutex
+    knownNodes []string
+    bestHeight int
+    requestedBlocks map[string]*Peer
+    peers map[string]*Peer
+    inbound map[*Peer]bool
+    listener net.Listener
+}
+
+type outMessage struct {
+    peer *Peer
+    message
+}
+
 type Addr struct {
     AddrList []string
 }
@@ -43,6 +78,7 @@ type Block struct {
 
 type GetBlocks struct {
     AddrFrom string
+    Locator [][]byte
 }
 
 type GetData struct {
@@ -62,10 +98,86 @@ type Tx struct {
     Transaction []byte
 }
 
-type Version struct {
-    Version int
-    BestHeight int
-    AddrFrom string
+type Payload interface {
+    Encode(w *codec.Writer)
+    Decode(r *codec.Reader)
+}
+
+func (m *Addr) Encode(w *codec.Writer) {
+    w.PutUint32(uint32(len(m.AddrList)))
+    for _, addr := range m.AddrList {
+        w.PutString(addr)
+    }
+}
+
+func (m *Addr) Decode(r *codec.Reader) {
+    for i, n := 0, r.Count(); i < n; i++ {
+        m.AddrList = append(m.AddrList, r.String())
+    }
+}
+
+func (m *Block) Encode(w *codec.Writer) {
+    w.PutString(m.AddrFrom)
+    w.PutBytes(m.Block)
+}
+
+func (m *Block) Decode(r *codec.Reader) {
+    m.AddrFrom = r.String()
+    m.Block = r.Bytes()
+}
+
+func (m *GetBlocks) Encode(w *codec.Writer) {
+    w.PutString(m.AddrFrom)
+    w.PutUint32(uint32(len(m.Locator)))
+    for _, hash := range m.Locator {
+        w.PutBytes(hash)
+    }
+}
+
+func (m *GetBlocks) Decode(r *codec.Reader) {
+    m.AddrFrom = r.String()
+    for i, n := 0, r.Count(); i < n; i++ {
+        m.Locator = append(m.Locator, r.Bytes())
+    }
+}
+
+func (m *GetData) Encode(w *codec.Writer) {
+    w.PutString(m.AddrFrom)
+    w.PutString(m.Type)
+    w.PutBytes(m.ID)
+}
+
+func (m *GetData) Decode(r *codec.Reader) {
+    m.AddrFrom = r.String()
+    m.Type = r.String()
+    m.ID = r.Bytes()
+}
+
+func (m *Inv) Encode(w *codec.Writer) {
+    w.PutString(m.AddrFrom)
+    w.PutString(m.Type)
+    w.PutUint32(uint32(len(m.Items)))
+    for _, item := range m.Items {
+        w.PutBytes(item)
+    }
+}
+
+func (m *Inv) Decode(r *codec.Reader) {
+    m.AddrFrom = r.String()
+    m.Type = r.String()
+    for i, n := 0, r.Count(); i < n; i++ {
+        m.Items = append(m.Items, r.Bytes())
+    }
+}
+
+func (m *Tx) Encode(w *codec.Writer) {
+    w.PutString(m.AddrFrom)
+    w.PutBytes(m.Transaction)
+}
+
+func (m *Tx) Decode(r *codec.Reader) {
+    m.AddrFrom = r.String()
+    m.Transaction = r.Bytes()
 }
 
 func CmdToBytes(cmd string) []byte {
@@ -88,40 +200,43 @@ func BytesToCmd(bytes []byte) string {
     return fmt.Sprintf("%s", cmd)
 }
 
-func ExtractCmd(request []byte) []byte {
-    return request[:commandLength]
-}
-
-func RequestBlocks() {
-    for _, node := range KnownNodes {
-        SendGetBlocks(node)
-    }
-}
-
-func CloseDB(chain *blockchain.BlockChain) {
-    d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-    
-    d.WaitForDeathWithFunc(func() {
-        defer os.Exit(1)
-        defer runtime.Goexit()
-        chain.Database.Close()
-    })
-}
-
-func GobEncode(data interface{}) []byte {
-    var buff bytes.Buffer
-
-    enc := gob.NewEncoder(&buff)
-    err := enc.Encode(data)
+func NewNode(chain *blockchain.BlockChain, address string) (*Node, error) {
+    nonce, err := newNonce()
     if err != nil {
-        log.Panic(err)
+        return nil, err
+    }
+    n := &Node{
+        Address: address,
+        Listen: address,
+        Seeds: append([]string{}, chain.Params.Seeds...),
+        Chain: chain,
+        Pool: mempool.New(chain, mempool.DefaultMaxSize),
+        MaxBlockSize: mempool.DefaultMaxBlockSize,
+        MinerWorkers: runtime.NumCPU(),
+        nonce: nonce,
+        quit: make(chan struct{}),
+        orphans: newOrphanPool(),
+        requestedBlocks: make(map[string]*Peer),
+        peers: make(map[string]*Peer),
+        inbound: make(map[*Peer]bool),
+    }
+    chain.OnOrphanedTx = func(tx *blockchain.Transaction) {
+        if _, err := n.Pool.Add(tx); err != nil {
+            log.Printf("dropped orphaned tx: %s\n", err)
+        }
     }
-    return buff.Bytes()
+    chain.OnConnectedBlock = n.Pool.BlockConnected
+    return n, nil
 }
 
+func (n *Node) KnownNodes() []string {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    return append([]string{}, n.knownNodes...)
+}
 
-func NodeIsKnown(addr string) bool {
-    for _, node := range KnownNodes {
+func (n *Node) isKnown(addr string) bool {
+    for _, node := range n.knownNodes {
         if node == addr {
             return true
         }
@@ -129,352 +244,413 @@ func NodeIsKnown(addr string) bool {
     return false
 }
 
-func MineTx(chain *blockchain.BlockChain, sincerity int) {
-    var txs []*blockchain.Transaction
-
-    for id := range memoryPool {
-        fmt.Printf("tx: %s\n", memoryPool[id].ID)
-        tx := memoryPool[id]
-        if chain.VerifyTransaction(&tx) {
-            txs = append(txs, &tx)
-        }
-    }
-
-    if len(txs) == 0 {
-        fmt.Println("All transactions are invalid")
-        return
+func (n *Node) addKnownNode(addr string) bool {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    if addr == "" || addr == n.Address || n.isKnown(addr) || len(n.knownNodes) >= maxKnownNodes {
+        return false
     }
+    n.knownNodes = append(n.knownNodes, addr)
+    return true
+}
 
-    cbTx := blockchain.CoinbaseTx(mineAddress, "", sincerity)
-    txs = append(txs, cbTx)
-
-    newBlock := chain.MineBlock(txs)
-    UTXOSet := blockchain.UTXOSet{chain}
-    UTXOSet.Reindex()
-
-    fmt.Println("New block mined")
-
-    for _, tx := range txs {
-        txID := hex.EncodeToString(tx.ID)
-        delete(memoryPool, txID)
-    }
+func (n *Node) removeKnownNode(addr string) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
 
-    for _, node := range KnownNodes {
-        if node != nodeAddress {
-            SendInv(node, "block", [][]byte{newBlock.Hash})
+    var updatedNodes []string
+    for _, node := range n.knownNodes {
+        if node != addr {
+            updatedNodes = append(updatedNodes, node)
         }
     }
+    n.knownNodes = updatedNodes
+}
 
-    if len(memoryPool) > 0 {
-        MineTx(chain, sincerity)
+func (n *Node) broadcastInv(kind string, id []byte, except *Peer) {
+    for _, p := range n.Peers() {
+        if p == except || !p.handshakeDone() {
+            continue
+        }
+        n.queueSend(p, "inv", &Inv{n.Address, kind, [][]byte{id}})
     }
 }
 
-func SendAddr(address string) {
-    nodes := Addr{KnownNodes}
-    nodes.AddrList = append(nodes.AddrList, nodeAddress)
-    payload := GobEncode(nodes)
-    request := append(CmdToBytes("addr"), payload ...)
-
-    SendData(address, request)
+func (n *Node) queueSend(p *Peer, command string, data Payload) {
+    n.outbox = append(n.outbox, outMessage{p, message{command, EncodePayload(data)}})
 }
 
-func SendBlock(addr string, b *blockchain.Block) {
-    data := Block{nodeAddress, b.Serialize()}
-    payload := GobEncode(data)
-    request := append(CmdToBytes("block"), payload ...)
-
-    SendData(addr, request)
+func (n *Node) takeOutbox() []outMessage {
+    outbox := n.outbox
+    n.outbox = nil
+    return outbox
 }
 
-func SendInv(address, kind string, items[][]byte) {
-    inventory := Inv{nodeAddress, kind, items}
-    payload := GobEncode(inventory)
-    request := append(CmdToBytes("inv"), payload ...)
-
-    SendData(address, request)
+func deliver(outbox []outMessage) {
+    for _, out := range outbox {
+        if err := out.peer.sendMessage(out.message); err != nil {
+            log.Printf("%s to %s: %s\n", out.command, out.peer, err)
+        }
+    }
 }
 
-func SendTx(addr string, txn *blockchain.Transaction) {
-    data := Tx{nodeAddress, txn.Serialize()}
-    payload := GobEncode(data)
-    request := append(CmdToBytes("tx"), payload ...)
-
-    SendData(addr, request)
+func EncodePayload(data Payload) []byte {
+    w := codec.NewWriter()
+    data.Encode(w)
+    return w.Bytes()
 }
 
-func SendVersion(addr string, chain *blockchain.BlockChain) {
-    bestHeight := chain.GetBestHeight()
-    payload := GobEncode(Version{version, bestHeight, nodeAddress})
-    request := append(CmdToBytes("version"), payload ...)
-
-    SendData(addr, request)
-}
-
-func SendGetBlocks(addr string) {
-    payload := GobEncode(GetBlocks{nodeAddress})
-    request := append(CmdToBytes("getblocks"), payload ...)
-
-    SendData(addr, request)
+func DecodePayload(data []byte, payload Payload) error {
+    r := codec.NewReader(data)
+    payload.Decode(r)
+    if err := r.Finish(); err != nil {
+        return fmt.Errorf("%w: %s", ErrBadPayload, err)
+    }
+    return nil
 }
 
-func SendGetData(addr string, kind string, id []byte) {
-    payload := GobEncode(GetData{nodeAddress, kind, id})
-    request := append(CmdToBytes("getdata"), payload ...)
+func (n *Node) sendAddr(p *Peer) {
+    nodes := Addr{n.KnownNodes()}
+    nodes.AddrList = append(nodes.AddrList, n.Address)
 
-    SendData(addr, request)
+    n.queueSend(p, "addr", &nodes)
 }
 
-func SendData(addr string, data[]byte) {
-    conn, err := net.Dial(protocol, addr)
-
-    if err != nil {
-        fmt.Printf("%s is not available\n", addr)
-        var updatedNodes []string
+func (n *Node) HandleAddr(p *Peer, request []byte) error {
+    var payload Addr
 
-        for _, node := range KnownNodes {
-            if node != addr {
-                updatedNodes = append(updatedNodes, node)
-            }
-        }
-        KnownNodes = updatedNodes
-        return
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
     }
-    defer conn.Close()
 
-    _, err = io.Copy(conn, bytes.NewReader(data))
-    if err != nil {
-        log.Panic(err)
+    if len(payload.AddrList) > maxAddrs {
+        return fmt.Errorf("%w: %d addresses, at most %d", ErrBadPayload, len(payload.AddrList), maxAddrs)
+    }
+    if n.ConnectOnly {
+        return nil
     }
-}
-func HandleAddr(request []byte) {
-    var buff bytes.Buffer
-    var payload Addr
 
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    err := dec.Decode(&payload)
-    if err != nil {
-        log.Panic(err)
+    for _, addr := range payload.AddrList {
+        if n.addKnownNode(addr) {
+            go n.dial(addr)
+        }
     }
-    
-    KnownNodes = append(KnownNodes, payload.AddrList ...)
-    fmt.Printf("there are %d known nodes \n", len(KnownNodes)) 
-    RequestBlocks()
+    fmt.Printf("there are %d known nodes \n", len(n.KnownNodes()))
+    return nil
 }
 
-func HandleBlock(request []byte, chain *blockchain.BlockChain) {
-    var buff bytes.Buffer
+func (n *Node) HandleBlock(p *Peer, request []byte) error {
     var payload Block
 
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    err := dec.Decode(&payload)
-    if err != nil {
-        log.Panic(err)
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
+    }
+    if n.Chain.Light {
+        return ErrLightNode
     }
 
-    blockData := payload.Block
-    block := blockchain.Deserialize(blockData)
+    block, err := blockchain.Deserialize(payload.Block)
+    if err != nil {
+        return err
+    }
     
     fmt.Println("Received a new block!")
-    chain.AddBlock(block)
+    isNew := !n.Chain.HasBlock(block.Hash)
+    err = n.addBlock(block)
+    if errors.Is(err, blockchain.ErrUnknownParent) && block.Difficulty < n.Chain.Params.Retarget.MinDifficulty {
+        err = fmt.Errorf("%w: orphan at %d is below the minimum of %d", blockchain.ErrBadDifficulty, block.Difficulty, n.Chain.Params.Retarget.MinDifficulty)
+    }
+    if errors.Is(err, blockchain.ErrUnknownParent) {
+        n.orphans.Add(block, len(payload.Block))
+        fmt.Printf("Stored orphan block %x, %d orphans\n", block.Hash, n.orphans.Len())
+
+        n.mu.Lock()
+        p.moreBlocks = true
+        n.mu.Unlock()
+        return n.blockReceived(p, block.Hash)
+    }
+    if err != nil {
+        n.mu.Lock()
+        n.releaseBlocks(p)
+        n.mu.Unlock()
+        return fmt.Errorf("rejected block %x: %w", block.Hash, err)
+    }
 
     fmt.Printf("Added block %x\n", block.Hash)
+    if isNew {
+        n.broadcastInv("block", block.Hash, p)
+    }
+    n.connectOrphans(block.Hash)
+
+    return n.blockReceived(p, block.Hash)
+}
 
-    if len(blocksInTransit) > 0 {
-        blockHash := blocksInTransit[0]
-        SendGetData(payload.AddrFrom, "block", blockHash)
-        blocksInTransit = blocksInTransit[1:]
-    } else {
-        UTXOSet := blockchain.UTXOSet{chain}
-        UTXOSet.Reindex()
+func (n *Node) addBlock(block *blockchain.Block) error {
+    tip := n.Chain.LastHash
+    if err := n.Chain.AddBlock(block); err != nil {
+        return err
+    }
+    if !bytes.Equal(n.Chain.LastHash, tip) && !bytes.Equal(block.PrevHash, tip) {
+        if dropped := n.Pool.Revalidate(); dropped > 0 {
+            fmt.Printf("Dropped %d transactions invalidated by the reorganization\n", dropped)
+        }
     }
+    if !bytes.Equal(n.Chain.LastHash, tip) {
+        n.updateBestHeight()
+        n.restartMining()
+    }
+    return nil
+}
+
+func (n *Node) updateBestHeight() {
+    height, err := n.Chain.GetBestHeight()
+    if err != nil {
+        log.Printf("failed to read the best height: %s\n", err)
+        return
+    }
+    n.mu.Lock()
+    n.bestHeight = height
+    n.mu.Unlock()
 }
 
-func HandleInv(request []byte, chain *blockchain.BlockChain) {
-    var buff bytes.Buffer
+func (n *Node) HandleInv(p *Peer, request []byte) error {
     var payload Inv
 
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    err := dec.Decode(&payload)
-    if err != nil {
-        log.Panic(err)
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
     }
 
     fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
+    if len(payload.Items) == 0 {
+        return nil
+    }
+    if n.Chain.Light {
+        if payload.Type == "block" {
+            return n.requestHeaders(p)
+        }
+        return nil
+    }
     
     if payload.Type == "block" {
-        blocksInTransit = payload.Items
-        blockHash := payload.Items[0]
-        SendGetData(payload.AddrFrom, "block", blockHash)
-
-        newInTransit := [][]byte{}
-        for _, b := range blocksInTransit {
-            if bytes.Compare(b, blockHash) != 0 {
-                newInTransit = append(newInTransit, b)
-            }
-        }
-        blocksInTransit = newInTransit
+        return n.queueBlocks(p, payload.Items)
     }
 
     if payload.Type == "tx" {
         txID := payload.Items[0]
-        if memoryPool[hex.EncodeToString(txID)].ID == nil {
-            SendGetData(payload.AddrFrom, "tx", txID)
+        if !n.Pool.Has(txID) {
+            n.queueSend(p, "getdata", &GetData{n.Address, "tx", txID})
         }
     }
+    return nil
 }
 
-func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
-    var buff bytes.Buffer
+func (n *Node) HandleGetBlocks(p *Peer, request []byte) error {
     var payload GetBlocks
 
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    err := dec.Decode(&payload)
-    if err != nil {
-        log.Panic(err)
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
+    }
+    if n.Chain.Light {
+        return ErrLightNode
     }
 
-    blocks := chain.GetBlockHashes()
-    SendInv(payload.AddrFrom, "block", blocks)
+    blocks, err := n.Chain.LocateBlocks(payload.Locator)
+    if err != nil {
+        return err
+    }
+    if len(blocks) == 0 {
+        return nil
+    }
+    n.queueSend(p, "inv", &Inv{n.Address, "block", blocks})
+    return nil
 }
 
-func HandleGetData(request []byte, chain *blockchain.BlockChain) {
-    var buff bytes.Buffer
+func (n *Node) HandleGetData(p *Peer, request []byte) error {
     var payload GetData
 
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    err := dec.Decode(&payload)
-    if err != nil {
-        log.Panic(err)
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
+    }
+    if n.Chain.Light {
+        return ErrLightNode
     }
 
     if payload.Type == "block" {
-        block, err := chain.GetBlock([]byte(payload.ID))
+        block, err := n.Chain.GetBlock([]byte(payload.ID))
         if err != nil {
-            log.Panic(err)
-            return 
+            return err
         }
-        SendBlock(payload.AddrFrom, &block)
+        n.queueSend(p, "block", &Block{n.Address, block.Serialize()})
+        return nil
     }
     if payload.Type == "tx" {
-        txID := hex.EncodeToString(payload.ID)
-        tx := memoryPool[txID]
-        
-        SendTx(payload.AddrFrom, &tx)
+        tx, ok := n.Pool.Get(payload.ID)
+        if !ok {
+            return fmt.Errorf("transaction %x is not in the memory pool", payload.ID)
+        }
+        n.queueSend(p, "tx", &Tx{n.Address, tx.Serialize()})
+        return nil
     }
+    return nil
 }
 
-func HandleTx(request []byte, chain *blockchain.BlockChain, sincerity int) {
-    var buff bytes.Buffer
+func (n *Node) HandleTx(p *Peer, request []byte) error {
     var payload Tx
 
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    err := dec.Decode(&payload)
-    if err != nil {
-        log.Panic(err)
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
+    }
+    if n.Chain.Light {
+        return ErrLightNode
     }
     
-    txData := payload.Transaction
-    tx := blockchain.DeserializeTransactions(txData)
-    memoryPool[hex.EncodeToString(tx.ID)] = tx
+    tx, err := blockchain.DeserializeTransactions(payload.Transaction)
+    if err != nil {
+        return err
+    }
+    if _, err := n.Pool.Add(&tx); errors.Is(err, mempool.ErrAlreadyKnown) {
+        return nil
+    } else if err != nil {
+        return fmt.Errorf("rejected tx %x: %w", tx.ID, err)
+    }
 
-    fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+    poolSize := n.Pool.Len()
+    fmt.Printf("%s, %d\n", n.Address, poolSize)
+    n.broadcastInv("tx", tx.ID, p)
 
-    if nodeAddress == KnownNodes[0] {
-        for _, node := range KnownNodes {
-            if node != nodeAddress && node != payload.AddrFrom {
-                SendInv(node, "tx", [][]byte{tx.ID})
-            }
-        }
-    } else {
-        if len(memoryPool) >= 2 && len(mineAddress) > 0 {
-            MineTx(chain, sincerity)
-        }
+    if poolSize >= 2 && len(n.MinerAddress) > 0 {
+        return n.MineTx()
     }
+    return nil
 }
 
-func HandleVersion(request []byte, chain *blockchain.BlockChain) {
-    var buff bytes.Buffer
-    var payload Version
-
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    err := dec.Decode(&payload)
-    if err != nil {
-        log.Panic(err)
-    }
+func (n *Node) handleMessage(p *Peer, command string, payload []byte) {
+    n.chainMu.Lock()
+    n.dispatch(p, command, payload)
+    outbox := n.takeOutbox()
+    n.chainMu.Unlock()
 
-    bestHeight := chain.GetBestHeight()
-    otherHeight := payload.BestHeight
+    deliver(outbox)
+}
 
-    if bestHeight < otherHeight {
-        SendGetBlocks(payload.AddrFrom)
-    } else if bestHeight > otherHeight {
-        SendVersion(payload.AddrFrom, chain)
+func (n *Node) dispatch(p *Peer, command string, payload []byte) {
+    if n.closed {
+        return
     }
 
-    if !NodeIsKnown(payload.AddrFrom) {
-        KnownNodes = append(KnownNodes, payload.AddrFrom)
-    }
-}
+    fmt.Printf("Received %s command\n", command)
 
-func HandleConnection(conn net.Conn, chain *blockchain.BlockChain, sincerity int) {
-    req, err := ioutil.ReadAll(conn)
-    defer conn.Close()
-    if err != nil {
-        log.Panic(err)
+    if command != "version" && command != "verack" && !p.handshakeDone() {
+        log.Printf("%s from %s: %s: message sent before verack\n", command, p, ErrHandshake)
+        p.Close()
+        return
     }
-    
-    command := BytesToCmd(req[:commandLength])
-    fmt.Printf("Received %s command\n", command)
 
+    var err error
     switch command {
     case "addr":
-        HandleAddr(req)
+        err = n.HandleAddr(p, payload)
     case "block":
-        HandleBlock(req, chain)
+        err = n.HandleBlock(p, payload)
     case "inv":
-        HandleInv(req, chain)
+        err = n.HandleInv(p, payload)
     case "getblocks":
-        HandleGetBlocks(req, chain)
+        err = n.HandleGetBlocks(p, payload)
     case "getdata":
-        HandleGetData(req, chain)
+        err = n.HandleGetData(p, payload)
     case "tx":
-        HandleTx(req, chain, sincerity)
+        err = n.HandleTx(p, payload)
     case "version":
-        HandleVersion(req, chain)
+        err = n.HandleVersion(p, payload)
+    case "verack":
+        err = n.HandleVerack(p, payload)
+    case "getheaders":
+        err = n.HandleGetHeaders(p, payload)
+    case "headers":
+        err = n.HandleHeaders(p, payload)
+    case "getproofs":
+        err = n.HandleGetProofs(p, payload)
+    case "proofs":
+        err = n.HandleProofs(p, payload)
+    case "ping":
+        err = n.HandlePing(p, payload)
+    case "pong":
     default:
-        fmt.Println("unknown command")
+        err = fmt.Errorf("%w: %q", ErrUnknownCommand, command)
+    }
+    if err != nil {
+        log.Printf("%s from %s: %s\n", command, p, err)
+        if errors.Is(err, ErrHandshake) {
+            p.Close()
+        }
     }
 }
 
-func StartServer(nodeID, minerAddress string, sincerity int) {
-    nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-    mineAddress = minerAddress
-    ln, err := net.Listen(protocol, nodeAddress)
+func (n *Node) Start() error {
+    n.chainMu.Lock()
+    n.updateBestHeight()
+    n.chainMu.Unlock()
+
+    ln, err := net.Listen(protocol, n.Listen)
     if err != nil {
-        log.Panic(err)
+        return err
     }
-    defer ln.Close()
-    
-    chain := blockchain.ContinueBlockChain(nodeID)
-    defer chain.Database.Close()
-    go CloseDB(chain)
+    n.mu.Lock()
+    n.listener = ln
+    n.mu.Unlock()
+    for _, seed := range n.Seeds {
+        n.addKnownNode(seed)
+    }
+    go n.acceptLoop(ln)
+    go n.stallLoop()
 
-    if nodeAddress != KnownNodes[0] {
-        SendVersion(KnownNodes[0], chain)
+    for _, node := range n.KnownNodes() {
+        n.dial(node)
     }
+    return nil
+}
+
+func (n *Node) acceptLoop(ln net.Listener) {
     for {
         conn, err := ln.Accept()
         if err != nil {
-            log.Panic(err)
+            return
         }
-        go HandleConnection(conn, chain, sincerity)
+        n.acceptPeer(conn)
+    }
+}
+
+func (n *Node) Close() {
+    n.mu.Lock()
+    ln := n.listener
+    n.listener = nil
+    n.mu.Unlock()
+    if ln != nil {
+        ln.Close()
     }
+
+    n.closePeers()
+
+    n.chainMu.Lock()
+    if !n.closed {
+        close(n.quit)
+    }
+    n.closed = true
+    job := n.mining
+    n.mining = nil
+    n.chainMu.Unlock()
+
+    if job != nil {
+        job.cancel()
+        <-job.done
+    }
+}
+
+func (n *Node) ListenAndServe() error {
+    if err := n.Start(); err != nil {
+        return err
+    }
+    d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+    d.WaitForDeathWithFunc(n.Close)
+    return nil
 }
@@ -0,0 +1,248 @@
+package network
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/viscory/reciprocus/blockchain"
+    "github.com/viscory/reciprocus/storage"
+    "github.com/viscory/reciprocus/wallet"
+)
+
+func freeAddr(t *testing.T) string {
+    ln, err := net.Listen(protocol, "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    return ln.Addr().String()
+}
+
+func newTestNode(t *testing.T, chain *blockchain.BlockChain) *Node {
+    n, err := NewNode(chain, freeAddr(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    n.Seeds = nil
+    n.MinerWorkers = 1
+    return n
+}
+
+func startNode(t *testing.T, n *Node) *Node {
+    if err := n.Start(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(n.Close)
+    return n
+}
+
+func tip(n *Node) []byte {
+    n.chainMu.Lock()
+    defer n.chainMu.Unlock()
+    return n.Chain.LastHash
+}
+
+func waitForTip(t *testing.T, a, b *Node) {
+    deadline := time.Now().Add(20 * time.Second)
+    for time.Now().Before(deadline) {
+        if bytes.Equal(tip(a), tip(b)) {
+            return
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    t.Fatalf("tips did not converge: %x and %x", tip(a), tip(b))
+}
+
+func TestNodesSyncAndRelayMinedBlocks(t *testing.T) {
+    chain, err := blockchain.NewBlockChain(storage.NewMemory(), "regtest", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    version := chain.Params.AddressVersion
+    to, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    toAddr := string(to.VersionedAddress(version))
+
+    var senders []*wallet.Wallet
+    for i := 0; i < 2; i++ {
+        w, err := wallet.MakeWallet()
+        if err != nil {
+            t.Fatal(err)
+        }
+        coinbase, err := blockchain.CoinbaseTx(string(w.VersionedAddress(version)), "", chain.Params.BlockReward(0))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, _, err := chain.MineBlock(context.Background(), []*blockchain.Transaction{coinbase}, 0); err != nil {
+            t.Fatal(err)
+        }
+        senders = append(senders, w)
+    }
+    UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+    var txs []*blockchain.Transaction
+    for _, w := range senders {
+        tx, err := blockchain.NewTransaction(w, toAddr, 1, 0, &UTXOSet)
+        if err != nil {
+            t.Fatal(err)
+        }
+        txs = append(txs, tx)
+    }
+
+    empty, err := blockchain.NewBlockChain(storage.NewMemory(), "regtest", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    miner := newTestNode(t, chain)
+    miner.MinerAddress = toAddr
+    startNode(t, miner)
+    follower := newTestNode(t, empty)
+    follower.Seeds = []string{miner.Address}
+    startNode(t, follower)
+    waitForTip(t, miner, follower)
+
+    for _, tx := range txs {
+        if err := SubmitTx(chain.Params, follower.Address, tx); err != nil {
+            t.Fatal(err)
+        }
+    }
+    deadline := time.Now().Add(20 * time.Second)
+    for !bytes.Equal(tip(follower), tip(miner)) || miner.Pool.Len() > 0 || follower.Pool.Len() > 0 {
+        if time.Now().After(deadline) {
+            t.Fatalf("mined transactions were not relayed, pools hold %d and %d", miner.Pool.Len(), follower.Pool.Len())
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+
+    miner.chainMu.Lock()
+    height, err := miner.Chain.GetBestHeight()
+    miner.chainMu.Unlock()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if height != 3 {
+        t.Errorf("best height is %d, want 3", height)
+    }
+}
+
+func TestCheckVersionGenesis(t *testing.T) {
+    chain, err := blockchain.NewBlockChain(storage.NewMemory(), "regtest", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    n := newTestNode(t, chain)
+    genesis, err := n.genesisHash()
+    if err != nil {
+        t.Fatal(err)
+    }
+    p := &Peer{node: n, Inbound: true}
+
+    tests := []struct {
+        name string
+        services uint64
+        genesis []byte
+        ok bool
+    }{
+        {"client without genesis", 0, nil, true},
+        {"block peer without genesis", ServiceBlocks, nil, false},
+        {"block peer on another chain", ServiceBlocks, make([]byte, len(genesis)), false},
+        {"block peer on this chain", ServiceBlocks, genesis, true},
+    }
+    for _, test := range tests {
+        v := &Version{Version: version, Services: test.services, Genesis: test.genesis, Nonce: n.nonce + 1}
+        err := n.checkVersion(p, v)
+        if test.ok && err != nil {
+            t.Errorf("%s: %v", test.name, err)
+        }
+        if !test.ok && !errors.Is(err, ErrHandshake) {
+            t.Errorf("%s: got %v, want %v", test.name, err, ErrHandshake)
+        }
+    }
+}
+
+func TestOrphanBelowMinimumDifficultyIsRejected(t *testing.T) {
+    chain, err := blockchain.NewBlockChain(storage.NewMemory(), "main", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    n := newTestNode(t, chain)
+    p := newPeer(n, nil, "", true)
+    w, err := wallet.MakeWallet()
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := string(w.VersionedAddress(chain.Params.AddressVersion))
+
+    for _, difficulty := range []int{1, chain.Params.Retarget.MinDifficulty} {
+        coinbase, err := blockchain.CoinbaseTx(addr, "", chain.Params.BlockReward(0))
+        if err != nil {
+            t.Fatal(err)
+        }
+        block := blockchain.NewBlock([]*blockchain.Transaction{coinbase}, make([]byte, 32), 5, difficulty, 0)
+        if _, err := block.Mine(context.Background(), 1); err != nil {
+            t.Fatal(err)
+        }
+        err = n.HandleBlock(p, EncodePayload(&Block{Block: block.Serialize()}))
+        if difficulty < chain.Params.Retarget.MinDifficulty {
+            if !errors.Is(err, blockchain.ErrBadDifficulty) || n.orphans.Len() != 0 {
+                t.Errorf("orphan at difficulty %d returned %v and left %d orphans", difficulty, err, n.orphans.Len())
+            }
+            continue
+        }
+        if err != nil || n.orphans.Len() != 1 {
+            t.Errorf("orphan at difficulty %d returned %v and left %d orphans", difficulty, err, n.orphans.Len())
+        }
+    }
+}
+
+func TestRetryStalledBlocksKeepsRequestOrder(t *testing.T) {
+    chain, err := blockchain.NewBlockChain(storage.NewMemory(), "regtest", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    n := newTestNode(t, chain)
+    var peers []*Peer
+    for _, addr := range []string{"stalled", "other"} {
+        p := newPeer(n, nil, addr, false)
+        p.version = &Version{Services: ServiceBlocks}
+        close(p.ready)
+        n.peers[addr] = p
+        peers = append(peers, p)
+    }
+    stalled, other := peers[0], peers[1]
+
+    var hashes [][]byte
+    for i := 0; i < 5+maxBlocksInFlight+4; i++ {
+        hashes = append(hashes, bytes.Repeat([]byte{byte(i + 1)}, 32))
+    }
+    if err := n.queueBlocks(stalled, hashes[:5]); err != nil {
+        t.Fatal(err)
+    }
+    if err := n.queueBlocks(other, hashes[5:]); err != nil {
+        t.Fatal(err)
+    }
+    n.mu.Lock()
+    for key := range stalled.blocksInFlight {
+        stalled.blocksInFlight[key] = time.Now().Add(-time.Second)
+    }
+    n.mu.Unlock()
+
+    n.retryStalledBlocks()
+    want := append(append([][]byte{}, hashes[:5]...), hashes[5+maxBlocksInFlight:]...)
+    if len(other.blockQueue) != len(want) {
+        t.Fatalf("%d blocks queued for the other peer, want %d", len(other.blockQueue), len(want))
+    }
+    for i, hash := range want {
+        if !bytes.Equal(other.blockQueue[i], hash) {
+            t.Errorf("queued block %d is %x, want %x", i, other.blockQueue[i], hash)
+        }
+    }
+    if len(stalled.inFlightOrder) != 0 || len(stalled.blocksInFlight) != 0 {
+        t.Error("the stalled peer still has blocks in flight")
+    }
+}
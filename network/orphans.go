@@ -0,0 +1,112 @@
+package network
+
+import (
+    "github.com/viscory/reciprocus/blockchain"
+
+    "encoding/hex"
+    "fmt"
+    "log"
+)
+
+const (
+    maxOrphanBlocks = 100
+    maxOrphanBytes = 16 << 20
+)
+
+type orphanBlock struct {
+    block *blockchain.Block
+    size int
+}
+
+type orphanPool struct {
+    blocks map[string]*orphanBlock
+    children map[string][]string
+    order []string
+    size int
+}
+
+func newOrphanPool() *orphanPool {
+    return &orphanPool{
+        blocks: make(map[string]*orphanBlock),
+        children: make(map[string][]string),
+    }
+}
+
+func (o *orphanPool) Len() int {
+    return len(o.blocks)
+}
+
+func (o *orphanPool) Add(block *blockchain.Block, size int) {
+    key := hex.EncodeToString(block.Hash)
+    if _, ok := o.blocks[key]; ok || size > maxOrphanBytes {
+        return
+    }
+    for len(o.blocks) >= maxOrphanBlocks || o.size+size > maxOrphanBytes {
+        o.remove(o.order[0])
+    }
+
+    o.blocks[key] = &orphanBlock{block, size}
+    parent := hex.EncodeToString(block.PrevHash)
+    o.children[parent] = append(o.children[parent], key)
+    o.order = append(o.order, key)
+    o.size += size
+}
+
+func (o *orphanPool) remove(key string) *blockchain.Block {
+    orphan, ok := o.blocks[key]
+    if !ok {
+        return nil
+    }
+    delete(o.blocks, key)
+    o.size -= orphan.size
+
+    for i, k := range o.order {
+        if k == key {
+            o.order = append(o.order[:i], o.order[i+1:]...)
+            break
+        }
+    }
+
+    parent := hex.EncodeToString(orphan.block.PrevHash)
+    siblings := o.children[parent]
+    for i, k := range siblings {
+        if k == key {
+            siblings = append(siblings[:i], siblings[i+1:]...)
+            break
+        }
+    }
+    if len(siblings) == 0 {
+        delete(o.children, parent)
+    } else {
+        o.children[parent] = siblings
+    }
+    return orphan.block
+}
+
+func (o *orphanPool) TakeChildren(hash []byte) []*blockchain.Block {
+    keys := append([]string{}, o.children[hex.EncodeToString(hash)]...)
+
+    var blocks []*blockchain.Block
+    for _, key := range keys {
+        blocks = append(blocks, o.remove(key))
+    }
+    return blocks
+}
+
+func (n *Node) connectOrphans(hash []byte) {
+    parents := [][]byte{hash}
+    for len(parents) > 0 {
+        parent := parents[0]
+        parents = parents[1:]
+
+        for _, block := range n.orphans.TakeChildren(parent) {
+            if err := n.addBlock(block); err != nil {
+                log.Printf("rejected orphan block %x: %s\n", block.Hash, err)
+                continue
+            }
+            fmt.Printf("Added orphan block %x\n", block.Hash)
+            n.broadcastInv("block", block.Hash, nil)
+            parents = append(parents, block.Hash)
+        }
+    }
+}
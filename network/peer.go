@@ -0,0 +1,338 @@
+package network
+
+import (
+    "github.com/viscory/reciprocus/codec"
+
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "sync"
+    "time"
+)
+
+const (
+    sendQueueSize = 64
+    dialTimeout = 10 * time.Second
+    writeTimeout = 30 * time.Second
+    pingInterval = 2 * time.Minute
+    idleTimeout = 5 * time.Minute
+)
+
+var ErrPeerClosed = errors.New("peer connection is closed")
+
+type message struct {
+    command string
+    payload []byte
+}
+
+type Peer struct {
+    Inbound bool
+    node *Node
+    addr string
+    conn net.Conn
+    send chan message
+    control chan message
+    ready chan struct{}
+    quit chan struct{}
+    done chan struct{}
+    readyOnce sync.Once
+    closeOnce sync.Once
+
+    version *Version
+    versionSent bool
+    verackReceived bool
+
+    blockQueue [][]byte
+    blocksInFlight map[string]time.Time
+    inFlightOrder [][]byte
+    moreBlocks bool
+    proofRequests [][][]byte
+}
+
+type Ping struct {
+    Nonce uint64
+}
+
+func (m *Ping) Encode(w *codec.Writer) {
+    w.PutUint64(m.Nonce)
+}
+
+func (m *Ping) Decode(r *codec.Reader) {
+    m.Nonce = r.Uint64()
+}
+
+func newPeer(n *Node, conn net.Conn, addr string, inbound bool) *Peer {
+    return &Peer{
+        Inbound: inbound,
+        node: n,
+        addr: addr,
+        conn: conn,
+        send: make(chan message, sendQueueSize),
+        control: make(chan message, 2),
+        ready: make(chan struct{}),
+        blocksInFlight: make(map[string]time.Time),
+        quit: make(chan struct{}),
+        done: make(chan struct{}),
+    }
+}
+
+func (n *Node) Connect(addr string) (*Peer, error) {
+    n.mu.Lock()
+    p, ok := n.peers[addr]
+    n.mu.Unlock()
+    if ok {
+        return p, nil
+    }
+
+    conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+    if err != nil {
+        return nil, err
+    }
+
+    n.mu.Lock()
+    if n.listener == nil {
+        n.mu.Unlock()
+        conn.Close()
+        return nil, ErrNodeClosed
+    }
+    if existing, ok := n.peers[addr]; ok {
+        n.mu.Unlock()
+        conn.Close()
+        return existing, nil
+    }
+    p = newPeer(n, conn, addr, false)
+    n.peers[addr] = p
+    n.mu.Unlock()
+
+    p.start()
+    if err := n.pushVersion(p); err != nil {
+        p.Close()
+        return nil, err
+    }
+    return p, nil
+}
+
+func (n *Node) acceptPeer(conn net.Conn) {
+    p := newPeer(n, conn, "", true)
+    n.mu.Lock()
+    if n.listener == nil {
+        n.mu.Unlock()
+        conn.Close()
+        return
+    }
+    n.inbound[p] = true
+    n.mu.Unlock()
+    p.start()
+}
+
+func (n *Node) Peers() []*Peer {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    var open []*Peer
+    for _, p := range n.peers {
+        open = append(open, p)
+    }
+    for p := range n.inbound {
+        if n.peers[p.addr] != p {
+            open = append(open, p)
+        }
+    }
+    return open
+}
+
+func (n *Node) closePeers() {
+    for _, p := range n.Peers() {
+        p.Close()
+        p.Wait()
+    }
+}
+
+func (p *Peer) Addr() string {
+    p.node.mu.Lock()
+    defer p.node.mu.Unlock()
+    return p.addr
+}
+
+func (p *Peer) String() string {
+    if addr := p.Addr(); addr != "" {
+        return addr
+    }
+    return p.conn.RemoteAddr().String()
+}
+
+func (p *Peer) start() {
+    go p.readLoop()
+    go p.writeLoop()
+
+    time.AfterFunc(handshakeTimeout, func() {
+        if !p.handshakeDone() && !p.closing() {
+            log.Printf("%s: %s: timed out\n", p, ErrHandshake)
+            p.Close()
+        }
+    })
+}
+
+func (p *Peer) handshakeDone() bool {
+    select {
+    case <-p.ready:
+        return true
+    default:
+        return false
+    }
+}
+
+func (p *Peer) sendControl(command string, data Payload) error {
+    select {
+    case p.control <- message{command, EncodePayload(data)}:
+        return nil
+    case <-p.quit:
+        return fmt.Errorf("%w: %s", ErrPeerClosed, p)
+    }
+}
+
+func (p *Peer) Send(command string, data Payload) error {
+    return p.sendMessage(message{command, EncodePayload(data)})
+}
+
+func (p *Peer) sendMessage(msg message) error {
+    select {
+    case <-p.quit:
+        return fmt.Errorf("%w: %s", ErrPeerClosed, p)
+    default:
+    }
+    select {
+    case p.send <- msg:
+        return nil
+    case <-p.quit:
+        return fmt.Errorf("%w: %s", ErrPeerClosed, p)
+    }
+}
+
+func (p *Peer) Close() {
+    p.closeOnce.Do(func() {
+        close(p.quit)
+
+        n := p.node
+        n.mu.Lock()
+        addr := p.addr
+        if n.peers[addr] == p {
+            delete(n.peers, addr)
+        }
+        delete(n.inbound, p)
+        n.releaseBlocks(p)
+        n.mu.Unlock()
+
+        if !p.Inbound && !p.handshakeDone() {
+            n.removeKnownNode(addr)
+        }
+    })
+}
+
+func (p *Peer) Wait() {
+    <-p.done
+}
+
+func (p *Peer) closing() bool {
+    select {
+    case <-p.quit:
+        return true
+    default:
+        return false
+    }
+}
+
+func (p *Peer) readLoop() {
+    defer p.Close()
+
+    for {
+        p.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+        command, payload, err := ReadMessage(p.conn, p.node.Chain.Params.Magic)
+        if err != nil {
+            if err != io.EOF && !p.closing() {
+                log.Printf("%s: %s\n", p, err)
+            }
+            return
+        }
+        p.node.handleMessage(p, command, payload)
+    }
+}
+
+func (p *Peer) write(msg message) error {
+    p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+    return WriteMessage(p.conn, p.node.Chain.Params.Magic, msg.command, msg.payload)
+}
+
+func (p *Peer) writeLoop() {
+    defer close(p.done)
+    defer p.conn.Close()
+
+    ticker := time.NewTicker(pingInterval)
+    defer ticker.Stop()
+
+    var queue chan message
+    ready := p.ready
+    for {
+        select {
+        case <-ready:
+            if err := p.flush(p.control); err != nil {
+                log.Printf("%s: %s\n", p, err)
+                p.Close()
+                return
+            }
+            queue, ready = p.send, nil
+        case msg := <-p.control:
+            if err := p.write(msg); err != nil {
+                log.Printf("%s: %s\n", p, err)
+                p.Close()
+                return
+            }
+        case msg := <-queue:
+            if err := p.write(msg); err != nil {
+                log.Printf("%s: %s\n", p, err)
+                p.Close()
+                return
+            }
+        case <-ticker.C:
+            if queue == nil {
+                continue
+            }
+            ping := Ping{uint64(time.Now().UnixNano())}
+            if err := p.write(message{"ping", EncodePayload(&ping)}); err != nil {
+                p.Close()
+                return
+            }
+        case <-p.quit:
+            p.flush(p.control)
+            if p.handshakeDone() {
+                p.flush(p.send)
+            }
+            return
+        }
+    }
+}
+
+func (p *Peer) flush(queue chan message) error {
+    for {
+        select {
+        case msg := <-queue:
+            if err := p.write(msg); err != nil {
+                return err
+            }
+        default:
+            return nil
+        }
+    }
+}
+
+func (n *Node) HandlePing(p *Peer, payload []byte) error {
+    var ping Ping
+
+    if err := DecodePayload(payload, &ping); err != nil {
+        return err
+    }
+    n.queueSend(p, "pong", &ping)
+    return nil
+}
@@ -0,0 +1,270 @@
+package network
+
+import (
+    "github.com/viscory/reciprocus/blockchain"
+    "github.com/viscory/reciprocus/codec"
+    "github.com/viscory/reciprocus/wallet"
+
+    "errors"
+    "fmt"
+    "log"
+)
+
+var (
+    ErrLightNode = errors.New("light node does not serve blocks")
+    ErrUnrequested = errors.New("reply was not requested")
+)
+
+type GetHeaders struct {
+    AddrFrom string
+    Locator [][]byte
+}
+
+type Headers struct {
+    AddrFrom string
+    Headers [][]byte
+}
+
+type GetProofs struct {
+    AddrFrom string
+    PubKeyHashes [][]byte
+}
+
+type Proofs struct {
+    AddrFrom string
+    Proofs [][]byte
+}
+
+func (m *GetHeaders) Encode(w *codec.Writer) {
+    w.PutString(m.AddrFrom)
+    w.PutUint32(uint32(len(m.Locator)))
+    for _, hash := range m.Locator {
+        w.PutBytes(hash)
+    }
+}
+
+func (m *GetHeaders) Decode(r *codec.Reader) {
+    m.AddrFrom = r.String()
+    for i, n := 0, r.Count(); i < n; i++ {
+        m.Locator = append(m.Locator, r.Bytes())
+    }
+}
+
+func (m *Headers) Encode(w *codec.Writer) {
+    w.PutString(m.AddrFrom)
+    w.PutUint32(uint32(len(m.Headers)))
+    for _, header := range m.Headers {
+        w.PutBytes(header)
+    }
+}
+
+func (m *Headers) Decode(r *codec.Reader) {
+    m.AddrFrom = r.String()
+    for i, n := 0, r.Count(); i < n; i++ {
+        m.Headers = append(m.Headers, r.Bytes())
+    }
+}
+
+func (m *GetProofs) Encode(w *codec.Writer) {
+    w.PutString(m.AddrFrom)
+    w.PutUint32(uint32(len(m.PubKeyHashes)))
+    for _, hash := range m.PubKeyHashes {
+        w.PutBytes(hash)
+    }
+}
+
+func (m *GetProofs) Decode(r *codec.Reader) {
+    m.AddrFrom = r.String()
+    for i, n := 0, r.Count(); i < n; i++ {
+        m.PubKeyHashes = append(m.PubKeyHashes, r.Bytes())
+    }
+}
+
+func (m *Proofs) Encode(w *codec.Writer) {
+    w.PutString(m.AddrFrom)
+    w.PutUint32(uint32(len(m.Proofs)))
+    for _, proof := range m.Proofs {
+        w.PutBytes(proof)
+    }
+}
+
+func (m *Proofs) Decode(r *codec.Reader) {
+    m.AddrFrom = r.String()
+    for i, n := 0, r.Count(); i < n; i++ {
+        m.Proofs = append(m.Proofs, r.Bytes())
+    }
+}
+
+func (n *Node) requestHeaders(p *Peer) error {
+    locator, err := n.Chain.BlockLocator()
+    if err != nil {
+        return err
+    }
+    n.queueSend(p, "getheaders", &GetHeaders{n.Address, locator})
+    return nil
+}
+
+func (n *Node) requestProofs(p *Peer) error {
+    var hashes [][]byte
+    for _, address := range n.WatchAddresses {
+        pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+        if err != nil {
+            return err
+        }
+        hashes = append(hashes, pubKeyHash)
+    }
+
+    for len(hashes) > 0 {
+        batch := hashes
+        if len(batch) > blockchain.MaxProofKeys {
+            batch = batch[:blockchain.MaxProofKeys]
+        }
+        hashes = hashes[len(batch):]
+        n.mu.Lock()
+        p.proofRequests = append(p.proofRequests, batch)
+        n.mu.Unlock()
+        n.queueSend(p, "getproofs", &GetProofs{n.Address, batch})
+    }
+    return nil
+}
+
+func (n *Node) HandleGetHeaders(p *Peer, request []byte) error {
+    var payload GetHeaders
+
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
+    }
+    if n.Chain.Light {
+        return ErrLightNode
+    }
+
+    headers, err := n.Chain.GetHeaders(payload.Locator)
+    if err != nil {
+        return err
+    }
+    reply := Headers{AddrFrom: n.Address}
+    for _, header := range headers {
+        reply.Headers = append(reply.Headers, header.Serialize())
+    }
+    n.queueSend(p, "headers", &reply)
+    return nil
+}
+
+func (n *Node) HandleHeaders(p *Peer, request []byte) error {
+    var payload Headers
+
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
+    }
+    if !n.Chain.Light {
+        return nil
+    }
+
+    var headers []*blockchain.BlockHeader
+    for _, data := range payload.Headers {
+        header, err := blockchain.DeserializeHeader(data)
+        if err != nil {
+            return err
+        }
+        headers = append(headers, header)
+    }
+    added, err := n.Chain.AddHeaders(headers)
+    if err != nil {
+        return fmt.Errorf("rejected headers from %s: %w", p, err)
+    }
+
+    n.updateBestHeight()
+
+    height, err := n.Chain.GetBestHeight()
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Added %d headers, best height is %d\n", added, height)
+
+    if len(payload.Headers) >= blockchain.MaxHeaders && added > 0 {
+        return n.requestHeaders(p)
+    }
+    n.mu.Lock()
+    v := p.version
+    n.mu.Unlock()
+    if v == nil || v.Services&ServiceProofs == 0 {
+        fmt.Printf("%s does not serve transaction proofs\n", p)
+        return nil
+    }
+    return n.requestProofs(p)
+}
+
+func (n *Node) HandleGetProofs(p *Peer, request []byte) error {
+    var payload GetProofs
+
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
+    }
+    if n.Chain.Light {
+        return ErrLightNode
+    }
+
+    proofs, err := n.Chain.ProveUnspent(payload.PubKeyHashes)
+    if err != nil {
+        return err
+    }
+    reply := Proofs{AddrFrom: n.Address}
+    for i := range proofs {
+        reply.Proofs = append(reply.Proofs, proofs[i].Serialize())
+    }
+    n.queueSend(p, "proofs", &reply)
+    return nil
+}
+
+func (n *Node) HandleProofs(p *Peer, request []byte) error {
+    var payload Proofs
+
+    if err := DecodePayload(request, &payload); err != nil {
+        return err
+    }
+    if !n.Chain.Light {
+        return nil
+    }
+    n.mu.Lock()
+    if len(p.proofRequests) == 0 {
+        n.mu.Unlock()
+        return fmt.Errorf("%w: proofs from %s", ErrUnrequested, p)
+    }
+    pubKeyHashes := p.proofRequests[0]
+    p.proofRequests = p.proofRequests[1:]
+    n.mu.Unlock()
+
+    var proofs []blockchain.TxProof
+    for _, data := range payload.Proofs {
+        proof, err := blockchain.DeserializeTxProof(data)
+        if err != nil {
+            return err
+        }
+        if err := n.Chain.VerifyTxProof(&proof); err != nil {
+            log.Println(err)
+            continue
+        }
+        proofs = append(proofs, proof)
+    }
+    fmt.Printf("Verified %d of %d transaction proofs\n", len(proofs), len(payload.Proofs))
+    if err := n.Chain.SaveTxProofs(pubKeyHashes, proofs); err != nil {
+        return err
+    }
+
+    for _, address := range n.WatchAddresses {
+        pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+        if err != nil {
+            return err
+        }
+        outputs, err := n.Chain.ProvenOutputs(pubKeyHash)
+        if err != nil {
+            return err
+        }
+        balance := 0
+        for _, out := range outputs {
+            balance += out.Value
+        }
+        fmt.Printf("Balance of %s: %d\n", address, balance)
+    }
+    return nil
+}
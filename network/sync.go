@@ -0,0 +1,205 @@
+package network
+
+import (
+    "github.com/viscory/reciprocus/blockchain"
+
+    "bytes"
+    "encoding/hex"
+    "log"
+    "time"
+)
+
+const (
+    maxBlocksInFlight = 16
+    blockTimeout = 20 * time.Second
+)
+
+func (n *Node) getBlocks() (*GetBlocks, error) {
+    locator, err := n.Chain.BlockLocator()
+    if err != nil {
+        return nil, err
+    }
+    return &GetBlocks{n.Address, locator}, nil
+}
+
+func (n *Node) syncFrom(p *Peer) error {
+    request, err := n.getBlocks()
+    if err != nil {
+        return err
+    }
+    n.queueSend(p, "getblocks", request)
+    return nil
+}
+
+func (n *Node) missingBlocks(hashes [][]byte) [][]byte {
+    var missing [][]byte
+    for _, hash := range hashes {
+        if !n.Chain.HasBlock(hash) {
+            missing = append(missing, hash)
+        }
+    }
+    return missing
+}
+
+func (n *Node) claimBlocks(p *Peer, hashes [][]byte) [][]byte {
+    var claimed [][]byte
+    for _, hash := range hashes {
+        key := hex.EncodeToString(hash)
+        if _, ok := n.requestedBlocks[key]; ok {
+            continue
+        }
+        n.requestedBlocks[key] = p
+        claimed = append(claimed, hash)
+    }
+    return claimed
+}
+
+func (n *Node) queueBlocks(p *Peer, hashes [][]byte) error {
+    missing := n.missingBlocks(hashes)
+
+    n.mu.Lock()
+    p.blockQueue = append(p.blockQueue, n.claimBlocks(p, missing)...)
+    if len(hashes) >= blockchain.MaxInvBlocks {
+        p.moreBlocks = true
+    }
+    n.mu.Unlock()
+
+    return n.requestBlocks(p)
+}
+
+func (n *Node) requestBlocks(p *Peer) error {
+    n.mu.Lock()
+    var batch [][]byte
+    for len(p.blocksInFlight) < maxBlocksInFlight && len(p.blockQueue) > 0 {
+        hash := p.blockQueue[0]
+        p.blockQueue = p.blockQueue[1:]
+        p.blocksInFlight[hex.EncodeToString(hash)] = time.Now().Add(blockTimeout)
+        p.inFlightOrder = append(p.inFlightOrder, hash)
+        batch = append(batch, hash)
+    }
+    more := p.moreBlocks && len(p.blockQueue) == 0 && len(p.blocksInFlight) == 0
+    if more {
+        p.moreBlocks = false
+    }
+    n.mu.Unlock()
+
+    for _, hash := range batch {
+        n.queueSend(p, "getdata", &GetData{n.Address, "block", hash})
+    }
+    if more {
+        return n.syncFrom(p)
+    }
+    return nil
+}
+
+func (n *Node) blockReceived(p *Peer, hash []byte) error {
+    key := hex.EncodeToString(hash)
+
+    n.mu.Lock()
+    if _, ok := p.blocksInFlight[key]; ok {
+        delete(p.blocksInFlight, key)
+        for i, inFlight := range p.inFlightOrder {
+            if bytes.Equal(inFlight, hash) {
+                p.inFlightOrder = append(p.inFlightOrder[:i:i], p.inFlightOrder[i+1:]...)
+                break
+            }
+        }
+    }
+    if n.requestedBlocks[key] == p {
+        delete(n.requestedBlocks, key)
+    }
+    n.mu.Unlock()
+
+    return n.requestBlocks(p)
+}
+
+func (n *Node) releaseBlocks(p *Peer) {
+    for _, hash := range p.blockQueue {
+        key := hex.EncodeToString(hash)
+        if n.requestedBlocks[key] == p {
+            delete(n.requestedBlocks, key)
+        }
+    }
+    for key := range p.blocksInFlight {
+        if n.requestedBlocks[key] == p {
+            delete(n.requestedBlocks, key)
+        }
+    }
+    p.blockQueue = nil
+    p.blocksInFlight = make(map[string]time.Time)
+    p.inFlightOrder = nil
+    p.moreBlocks = false
+}
+
+func (n *Node) blockPeer(except *Peer) *Peer {
+    best := except
+    load := -1
+    consider := func(p *Peer) {
+        if p == except || p.version == nil || p.version.Services&ServiceBlocks == 0 || !p.handshakeDone() || p.closing() {
+            return
+        }
+        if l := len(p.blockQueue) + len(p.blocksInFlight); load < 0 || l < load {
+            best, load = p, l
+        }
+    }
+    for _, p := range n.peers {
+        consider(p)
+    }
+    for p := range n.inbound {
+        consider(p)
+    }
+    return best
+}
+
+func (n *Node) retryStalledBlocks() {
+    now := time.Now()
+    for _, p := range n.Peers() {
+        n.mu.Lock()
+        stalled := false
+        for _, deadline := range p.blocksInFlight {
+            if now.After(deadline) {
+                stalled = true
+                break
+            }
+        }
+        if !stalled {
+            n.mu.Unlock()
+            continue
+        }
+
+        hashes := append(append([][]byte{}, p.inFlightOrder...), p.blockQueue...)
+        more := p.moreBlocks
+        n.releaseBlocks(p)
+        other := n.blockPeer(p)
+        other.moreBlocks = other.moreBlocks || more
+        retry := n.claimBlocks(other, n.missingBlocks(hashes))
+        other.blockQueue = append(retry, other.blockQueue...)
+        n.mu.Unlock()
+
+        log.Printf("%s: block download timed out, requesting %d blocks from %s\n", p, len(retry), other)
+        if err := n.requestBlocks(other); err != nil {
+            log.Println(err)
+        }
+    }
+}
+
+func (n *Node) stallLoop() {
+    ticker := time.NewTicker(blockTimeout / 4)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            n.chainMu.Lock()
+            if !n.closed {
+                n.retryStalledBlocks()
+            }
+            outbox := n.takeOutbox()
+            n.chainMu.Unlock()
+
+            deliver(outbox)
+        case <-n.quit:
+            return
+        }
+    }
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/dgraph-io/badger"
+)
+
+type BadgerStore struct {
+    db *badger.DB
+}
+
+type badgerTxn struct {
+    txn *badger.Txn
+}
+
+func BadgerExists(dir string) bool {
+    if _, err := os.Stat(filepath.Join(dir, "MANIFEST")); os.IsNotExist(err) {
+        return false
+    }
+    return true
+}
+
+func OpenBadger(dir string) (*BadgerStore, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    opts := badger.DefaultOptions
+    opts.Dir = dir
+    opts.ValueDir = dir
+
+    db, err := openDB(dir, opts)
+    if err != nil {
+        return nil, err
+    }
+    return &BadgerStore{db}, nil
+}
+
+func (s *BadgerStore) View(fn func(txn Txn) error) error {
+    return s.db.View(func(txn *badger.Txn) error {
+        return fn(badgerTxn{txn})
+    })
+}
+
+func (s *BadgerStore) Update(fn func(txn Txn) error) error {
+    return s.db.Update(func(txn *badger.Txn) error {
+        return fn(badgerTxn{txn})
+    })
+}
+
+func (s *BadgerStore) Close() error {
+    return s.db.Close()
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+    item, err := t.txn.Get(key)
+    if err == badger.ErrKeyNotFound {
+        return nil, ErrNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Put(key, value []byte) error {
+    err := t.txn.Set(key, value)
+    if err == badger.ErrReadOnlyTxn {
+        return ErrReadOnly
+    }
+    return err
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+    err := t.txn.Delete(key)
+    if err == badger.ErrReadOnlyTxn {
+        return ErrReadOnly
+    }
+    return err
+}
+
+func (t badgerTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+    it := t.txn.NewIterator(badger.DefaultIteratorOptions)
+    defer it.Close()
+
+    for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+        item := it.Item()
+        value, err := item.ValueCopy(nil)
+        if err != nil {
+            return err
+        }
+        if err := fn(item.KeyCopy(nil), value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
+    lockPath := filepath.Join(dir, "LOCK")
+    if err := os.Remove(lockPath); err != nil {
+        return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+    }
+    retryOpts := originalOpts
+    retryOpts.Truncate = true
+    db, err := badger.Open(retryOpts)
+    return db, err
+}
+
+func openDB(dir string, opts badger.Options) (*badger.DB, error) {
+    db, err := badger.Open(opts)
+    if err == nil {
+        return db, nil
+    }
+    if strings.Contains(err.Error(), "LOCK") {
+        if db, err := retry(dir, opts); err == nil {
+            log.Println("database unlocked, value log truncated")
+            return db, nil
+        }
+        log.Println("could not unlock database:", err)
+    }
+    return nil, err
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+    "sort"
+    "strings"
+    "sync"
+)
+
+type MemoryStore struct {
+    mu sync.RWMutex
+    data map[string][]byte
+}
+
+type memoryTxn struct {
+    store *MemoryStore
+    writes map[string][]byte
+}
+
+func NewMemory() *MemoryStore {
+    return &MemoryStore{data: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) View(fn func(txn Txn) error) error {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    return fn(&memoryTxn{store: s})
+}
+
+func (s *MemoryStore) Update(fn func(txn Txn) error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    txn := &memoryTxn{store: s, writes: make(map[string][]byte)}
+    if err := fn(txn); err != nil {
+        return err
+    }
+    for k, v := range txn.writes {
+        if v == nil {
+            delete(s.data, k)
+        } else {
+            s.data[k] = v
+        }
+    }
+    return nil
+}
+
+func (s *MemoryStore) Close() error {
+    return nil
+}
+
+func (t *memoryTxn) lookup(key string) ([]byte, bool) {
+    if v, ok := t.writes[key]; ok {
+        return v, v != nil
+    }
+    v, ok := t.store.data[key]
+    return v, ok
+}
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+    v, ok := t.lookup(string(key))
+    if !ok {
+        return nil, ErrNotFound
+    }
+    return append([]byte{}, v...), nil
+}
+
+func (t *memoryTxn) Put(key, value []byte) error {
+    if t.writes == nil {
+        return ErrReadOnly
+    }
+    t.writes[string(key)] = append([]byte{}, value...)
+    return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+    if t.writes == nil {
+        return ErrReadOnly
+    }
+    t.writes[string(key)] = nil
+    return nil
+}
+
+func (t *memoryTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+    seen := make(map[string]bool)
+    var keys []string
+    for _, m := range []map[string][]byte{t.store.data, t.writes} {
+        for k := range m {
+            if strings.HasPrefix(k, string(prefix)) && !seen[k] {
+                seen[k] = true
+                keys = append(keys, k)
+            }
+        }
+    }
+    sort.Strings(keys)
+
+    for _, k := range keys {
+        v, ok := t.lookup(k)
+        if !ok {
+            continue
+        }
+        if err := fn([]byte(k), append([]byte{}, v...)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+    "bytes"
+    "errors"
+    "testing"
+)
+
+func TestMemoryRoundTrip(t *testing.T) {
+    db := NewMemory()
+
+    err := db.Update(func(txn Txn) error {
+        for _, k := range []string{"utxo-b", "utxo-a", "lh"} {
+            if err := txn.Put([]byte(k), []byte("v-"+k)); err != nil {
+                return err
+            }
+        }
+        v, err := txn.Get([]byte("lh"))
+        if err != nil || string(v) != "v-lh" {
+            t.Errorf("uncommitted read = %q, %v", v, err)
+        }
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = db.View(func(txn Txn) error {
+        v, err := txn.Get([]byte("utxo-a"))
+        if err != nil {
+            return err
+        }
+        if !bytes.Equal(v, []byte("v-utxo-a")) {
+            t.Errorf("Get = %q", v)
+        }
+        if _, err := txn.Get([]byte("missing")); err != ErrNotFound {
+            t.Errorf("Get missing = %v, want ErrNotFound", err)
+        }
+        if err := txn.Put([]byte("lh"), nil); err != ErrReadOnly {
+            t.Errorf("Put in View = %v, want ErrReadOnly", err)
+        }
+
+        var keys []string
+        err = txn.Iterate([]byte("utxo-"), func(k, v []byte) error {
+            keys = append(keys, string(k))
+            return nil
+        })
+        if len(keys) != 2 || keys[0] != "utxo-a" || keys[1] != "utxo-b" {
+            t.Errorf("Iterate = %v", keys)
+        }
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestMemoryUpdateRollback(t *testing.T) {
+    db := NewMemory()
+    db.Update(func(txn Txn) error {
+        return txn.Put([]byte("a"), []byte("1"))
+    })
+
+    failed := errors.New("failed")
+    err := db.Update(func(txn Txn) error {
+        txn.Delete([]byte("a"))
+        txn.Put([]byte("b"), []byte("2"))
+        return failed
+    })
+    if err != failed {
+        t.Fatalf("Update = %v, want %v", err, failed)
+    }
+
+    db.View(func(txn Txn) error {
+        if _, err := txn.Get([]byte("a")); err != nil {
+            t.Errorf("rolled back delete: %v", err)
+        }
+        if _, err := txn.Get([]byte("b")); err != ErrNotFound {
+            t.Errorf("rolled back put: %v", err)
+        }
+        return nil
+    })
+}
@@ -0,0 +1,21 @@
+package storage
+
+import "errors"
+
+var (
+    ErrNotFound = errors.New("key not found")
+    ErrReadOnly = errors.New("write in a read-only transaction")
+)
+
+type Txn interface {
+    Get(key []byte) ([]byte, error)
+    Put(key, value []byte) error
+    Delete(key []byte) error
+    Iterate(prefix []byte, fn func(key, value []byte) error) error
+}
+
+type Store interface {
+    View(fn func(txn Txn) error) error
+    Update(fn func(txn Txn) error) error
+    Close() error
+}
@@ -6,21 +6,29 @@ import (
     "crypto/rand"
     "crypto/sha256"
     "bytes"
-    "log"
+    "errors"
+    "fmt"
+    "math/big"
     "golang.org/x/crypto/ripemd160"
 ) 
 
 const (
     checksumLength = 4
-    version = byte(0x00)
+    DefaultVersion = byte(0x00)
 )
 
+var ErrInvalidAddress = errors.New("address is not valid")
+
 type Wallet struct {
     PrivateKey ecdsa.PrivateKey
     PublicKey []byte
 }
 
 func (w Wallet) Address() []byte {
+    return w.VersionedAddress(DefaultVersion)
+}
+
+func (w Wallet) VersionedAddress(version byte) []byte {
     pubHash := PublicKeyHash(w.PublicKey)
 
     versionedHash := append([]byte{version}, pubHash...)
@@ -32,32 +40,49 @@ func (w Wallet) Address() []byte {
     return address
 }
 
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
     curve := elliptic.P256()
 
     private, err := ecdsa.GenerateKey(curve, rand.Reader)
     if err != nil {
-        log.Panic(err)
+        return ecdsa.PrivateKey{}, nil, err
     } 
-    pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)  
-    return *private, pub
+    return *private, encodePublicKey(private.PublicKey), nil
 }
 
-func MakeWallet() *Wallet {
-    private, public := NewKeyPair()
+func encodePublicKey(pub ecdsa.PublicKey) []byte {
+    size := (pub.Curve.Params().BitSize + 7) / 8
+    return append(pub.X.FillBytes(make([]byte, size)), pub.Y.FillBytes(make([]byte, size))...)
+}
+
+func walletFromKey(d []byte) (*Wallet, error) {
+    curve := elliptic.P256()
+    if len(d) == 0 || len(d) > (curve.Params().BitSize+7)/8 {
+        return nil, fmt.Errorf("%w: bad private key length %d", ErrCorruptWalletFile, len(d))
+    }
+
+    private := ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+    private.PublicKey.Curve = curve
+    private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(d)
+
+    return &Wallet{private, encodePublicKey(private.PublicKey)}, nil
+}
+
+func MakeWallet() (*Wallet, error) {
+    private, public, err := NewKeyPair()
+    if err != nil {
+        return nil, err
+    }
     wallet := Wallet{private, public}
 
-    return &wallet
+    return &wallet, nil
 }
 
 func PublicKeyHash(pubKey []byte) []byte {
     pubHash := sha256.Sum256(pubKey)
 
     hasher := ripemd160.New()
-    _, err := hasher.Write(pubHash[:])
-    if err != nil {
-        log.Panic(err)
-    }
+    hasher.Write(pubHash[:])
     publicRipMD := hasher.Sum(nil)
 
     return publicRipMD
@@ -70,8 +95,33 @@ func Checksum(payload []byte) []byte {
     return secondHash[:checksumLength]
 }
 
+func AddressToPubKeyHash(address string) ([]byte, error) {
+    if !ValidateAddress(address) {
+        return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+    }
+    pubKeyHash, err := Base58Decode([]byte(address))
+    if err != nil {
+        return nil, err
+    }
+    return pubKeyHash[1:len(pubKeyHash)-checksumLength], nil
+}
+
+func AddressVersion(address string) (byte, error) {
+    if !ValidateAddress(address) {
+        return 0, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+    }
+    fullHash, err := Base58Decode([]byte(address))
+    if err != nil {
+        return 0, err
+    }
+    return fullHash[0], nil
+}
+
 func ValidateAddress(address string) bool {
-    pubKeyHash := Base58Decode([]byte(address))
+    pubKeyHash, err := Base58Decode([]byte(address))
+    if err != nil || len(pubKeyHash) <= 1+checksumLength {
+        return false
+    }
     actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
     version := pubKeyHash[0]
     pubKeyHash = pubKeyHash[1:len(pubKeyHash)-checksumLength]
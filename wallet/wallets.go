@@ -4,34 +4,53 @@ import (
     "bytes"
     "crypto/elliptic"
     "encoding/gob"
+    "errors"
     "fmt"
     "io/ioutil"
-    "log"
     "os"
+    "path/filepath"
+    "sort"
+
+    "github.com/viscory/reciprocus/codec"
+)
+
+const (
+    walletFile = "wallets_%s.data"
+    walletFileVersion = byte(1)
 )
 
-const walletFile = "./tmp/wallets_%s.data"
+var (
+    ErrWalletNotFound = errors.New("wallet not found")
+    ErrCorruptWalletFile = errors.New("wallet file is corrupt")
+)
 
 type Wallets struct {
     Wallets map[string]*Wallet
+    path string
+    version byte
 }
 
-func CreateWallets(nodeId string) (*Wallets, error) {
+func CreateWallets(dir, nodeId string, version byte) (*Wallets, error) {
     wallets := Wallets{}
     wallets.Wallets = make(map[string]*Wallet)
+    wallets.path = filepath.Join(dir, fmt.Sprintf(walletFile, nodeId))
+    wallets.version = version
 
-    err := wallets.LoadFile(nodeId)
+    err := wallets.LoadFile()
 
     return &wallets, err
 }
 
-func (ws *Wallets) AddWallet() string {
-    wallet := MakeWallet()
-    address := fmt.Sprintf("%s", wallet.Address())
+func (ws *Wallets) AddWallet() (string, error) {
+    wallet, err := MakeWallet()
+    if err != nil {
+        return "", err
+    }
+    address := fmt.Sprintf("%s", wallet.VersionedAddress(ws.version))
 
     ws.Wallets[address] = wallet
 
-    return address
+    return address, nil
 }
 
 func (ws *Wallets) GetAllAddresses() []string {
@@ -44,48 +63,72 @@ func (ws *Wallets) GetAllAddresses() []string {
     return addresses
 }
 
-func (ws *Wallets) GetWallet(address string) Wallet {
-    return *ws.Wallets[address]
+func (ws *Wallets) GetWallet(address string) (Wallet, error) {
+    wallet, ok := ws.Wallets[address]
+    if !ok {
+        return Wallet{}, fmt.Errorf("%w: %s", ErrWalletNotFound, address)
+    }
+    return *wallet, nil
 }
 
-func (ws *Wallets) LoadFile(nodeId string) error {
-    walletFile := fmt.Sprintf(walletFile, nodeId)
-    if _,err := os.Stat(walletFile); os.IsNotExist(err) {
-        os.OpenFile(walletFile, os.O_RDONLY|os.O_CREATE, 0666)
+func (ws *Wallets) LoadFile() error {
+    if _,err := os.Stat(ws.path); os.IsNotExist(err) {
+        return nil
     }
-    
-    var wallets Wallets
 
-    fileContent, err := ioutil.ReadFile(walletFile)
+    fileContent, err := ioutil.ReadFile(ws.path)
     if err != nil {
         return err
     }
+    if len(fileContent) == 0 {
+        return nil
+    }
 
-    gob.Register(elliptic.P256())
-    decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-    err = decoder.Decode(&wallets)
-    if err != nil {
-        return err
+    if fileContent[0] != walletFileVersion {
+        return ws.loadLegacy(fileContent)
+    }
+    r := codec.NewReader(fileContent[1:])
+    for i, n := 0, r.Count(); i < n; i++ {
+        wallet, err := walletFromKey(r.Bytes())
+        if err != nil {
+            return err
+        }
+        ws.Wallets[string(wallet.VersionedAddress(ws.version))] = wallet
+    }
+    if err := r.Finish(); err != nil {
+        return fmt.Errorf("%w: %s", ErrCorruptWalletFile, err)
     }
-     
-    ws.Wallets = wallets.Wallets
     return nil
 }
 
-func (ws *Wallets) SaveFile(nodeId string) {
-    var content bytes.Buffer
-    walletFile := fmt.Sprintf(walletFile, nodeId)
+func (ws *Wallets) loadLegacy(fileContent []byte) error {
+    var wallets Wallets
 
     gob.Register(elliptic.P256())
+    decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+    if err := decoder.Decode(&wallets); err != nil {
+        return fmt.Errorf("%w: %s", ErrCorruptWalletFile, err)
+    }
 
-    encoder := gob.NewEncoder(&content)
-    err := encoder.Encode(ws)
-    if err!= nil {
-        log.Panic(err)
+    ws.Wallets = wallets.Wallets
+    return nil
+}
+
+func (ws *Wallets) SaveFile() error {
+    addresses := ws.GetAllAddresses()
+    sort.Strings(addresses)
+
+    w := codec.NewWriter()
+    w.PutUint8(walletFileVersion)
+    w.PutUint32(uint32(len(addresses)))
+    for _, address := range addresses {
+        private := ws.Wallets[address].PrivateKey
+        size := (private.Curve.Params().BitSize + 7) / 8
+        w.PutBytes(private.D.FillBytes(make([]byte, size)))
     }
 
-    err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
-    if err != nil {
-        log.Panic(err)
+    if err := os.MkdirAll(filepath.Dir(ws.path), 0755); err != nil {
+        return err
     }
+    return ioutil.WriteFile(ws.path, w.Bytes(), 0600)
 }